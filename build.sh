@@ -21,6 +21,15 @@ export GIT_SSL_NO_VERIFY=1
 go get "golang.org/x/text/encoding"
 go get "golang.org/x/text/encoding/charmap"
 go get "golang.org/x/net/html/charset"
+go get "github.com/ulikunitz/xz"
+
+# current releases of compress require newer Go than ELT_GO_VERSION (go.mod says 1.22,
+# zstd imports "slices"), so the last release, that builds with Go 1.14, is checked out
+if [ ! -d src/github.com/klauspost/compress ]; then
+  git clone https://github.com/klauspost/compress src/github.com/klauspost/compress
+fi
+git -C src/github.com/klauspost/compress checkout -q v1.11.13
+
 go get --insecure "github.com/Alexander-TX/go-sqlite3"
 
 # required by sqlite
@@ -308,6 +308,21 @@ func main() {
 
   //////////////////////////////////////////////
 
+  fmt.Printf("Checking integrity of end_time column... ")
+
+  var haveBadEnd int64
+  badEnd := db.QueryRow("SELECT COUNT(*) FROM search_meta WHERE end_time IS NOT NULL AND end_time <= start_time;")
+  err = badEnd.Scan(&haveBadEnd)
+  if err != nil {
+    fmt.Printf("ok (no end times)\n")
+  } else if (haveBadEnd != 0) {
+    Bail("%d entries end before they start\n", haveBadEnd)
+  } else {
+    fmt.Printf("ok\n")
+  }
+
+  //////////////////////////////////////////////
+
   fmt.Printf("Checking integrity of tags table... ")
 
   tagTableTest := db.QueryRow("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'tags';")
@@ -315,7 +330,7 @@ func main() {
 
   if err != nil {
     // make sure, that search_meta also does not have tags
-    distinctTags, err := db.Query("SELECT tag FROM search_meta WHERE tag != 0;")
+    distinctTags, err := db.Query("SELECT tags FROM search_meta WHERE tags != 0;")
     if err == nil && distinctTags.Next() {
       Bail("Database has tags, but no tags table\n")
     } else {
@@ -352,6 +367,275 @@ func main() {
 
   //////////////////////////////////////////////
 
+  fmt.Printf("Checking integrity of programme_tags table... ")
+
+  tagListTest := db.QueryRow("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'tag_list';")
+  err = tagListTest.Scan(&foobar)
+
+  if err != nil {
+    fmt.Printf("ok (bitmask only)\n")
+  } else {
+    var badLinks, badBits, badMasks int64
+
+    invalidLink := db.QueryRow("SELECT COUNT(*) FROM programme_tags WHERE NOT EXISTS (SELECT 1 FROM search_meta WHERE search_meta._id = programme_id) OR NOT EXISTS (SELECT 1 FROM tag_list WHERE tag_list._id = tag_id);")
+    err = invalidLink.Scan(&badLinks)
+    if err != nil {
+      Bail("Failed to check programme_tags table:\n %s\n", err.Error())
+    }
+
+    if badLinks != 0 {
+      Bail("Schedule is corrupt: %d programme tags don't have matching programme in search_meta or tag in tag_list table\n", badLinks)
+    }
+
+    invalidBit := db.QueryRow("SELECT COUNT(*) FROM tag_list WHERE bit IS NOT NULL AND NOT EXISTS (SELECT 1 FROM tags WHERE tags._id = tag_list.bit AND tags.tag = tag_list.tag);")
+    err = invalidBit.Scan(&badBits)
+    if err != nil {
+      Bail("Failed to check tag_list table:\n %s\n", err.Error())
+    }
+
+    if badBits != 0 {
+      Bail("Schedule is corrupt: %d entries of tag_list don't match tags table\n", badBits)
+    }
+
+    // both layouts must describe the same tags, as far as bitmask can hold them
+    mismatchedMask := db.QueryRow("SELECT COUNT(*) FROM search_meta WHERE tags != (SELECT COALESCE(SUM(tag_list.bit), 0) FROM programme_tags JOIN tag_list ON tag_list._id = programme_tags.tag_id WHERE programme_tags.programme_id = search_meta._id AND tag_list.bit IS NOT NULL);")
+    err = mismatchedMask.Scan(&badMasks)
+    if err != nil {
+      Bail("Failed to compare tags column with programme_tags table:\n %s\n", err.Error())
+    }
+
+    if badMasks != 0 {
+      Bail("Schedule is corrupt: %d entries have tags column, that does not match programme_tags table\n", badMasks)
+    }
+
+    fmt.Printf("ok\n")
+  }
+
+  //////////////////////////////////////////////
+
+  fmt.Printf("Checking integrity of programme_flags table... ")
+
+  flagsTableTest := db.QueryRow("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'programme_flags';")
+  err = flagsTableTest.Scan(&foobar)
+
+  if err != nil {
+    fmt.Printf("ok (no flags)\n")
+  } else {
+    var flagId, knownFlags int64
+    var flagName string
+
+    flags, err := db.Query("SELECT _id, flag FROM programme_flags ORDER BY _id;")
+    if err != nil {
+      Bail("Failed to query programme_flags table:\n %s\n", err.Error())
+    }
+
+    for flags.Next() {
+      err = flags.Scan(&flagId, &flagName)
+      if err != nil {
+        Bail("Failed to read from programme_flags table:\n %s\n", err.Error())
+      }
+
+      if bits.OnesCount(uint(flagId)) != 1 {
+        Bail("Identifier of flag '%s' must have exactly 1 bit set (_id = %d)\n", flagName, flagId)
+      }
+
+      knownFlags |= flagId
+    }
+
+    var haveBadFlags int64
+
+    badFlags := db.QueryRow("SELECT COUNT(*) FROM search_meta WHERE flags & ~? != 0;", knownFlags)
+    err = badFlags.Scan(&haveBadFlags)
+    if err != nil {
+      Bail("Failed to check flags column:\n %s\n", err.Error())
+    }
+
+    if haveBadFlags != 0 {
+      Bail("%d entries have flags, missing from programme_flags table\n", haveBadFlags)
+    }
+
+    fmt.Printf("ok\n")
+  }
+
+  //////////////////////////////////////////////
+
+  fmt.Printf("Checking integrity of credits table... ")
+
+  creditsTableTest := db.QueryRow("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'credits';")
+  err = creditsTableTest.Scan(&foobar)
+
+  if err != nil {
+    fmt.Printf("ok (no credits)\n")
+  } else {
+    var creditsTotal, haveValidCredit int64
+
+    creditsCount := db.QueryRow("SELECT COUNT(*) FROM credits;")
+    err = creditsCount.Scan(&creditsTotal)
+    if err != nil {
+      Bail("Failed to count rows in credits:\n %s\n", err.Error())
+    }
+
+    validCredit := db.QueryRow("SELECT COUNT(*) FROM credits WHERE EXISTS (SELECT 1 FROM search_meta WHERE search_meta._id = programme_id) AND EXISTS (SELECT 1 FROM text WHERE docid = person_id);")
+    err = validCredit.Scan(&haveValidCredit)
+    if err != nil {
+      Bail("Failed to count rows in credits without programme or person:\n %s\n", err.Error())
+    }
+
+    if creditsTotal != haveValidCredit {
+      Bail("Schedule is corrupt: %d of %d credits don't have matching programme in search_meta or person name in text table\n", creditsTotal - haveValidCredit, creditsTotal)
+    }
+
+    fmt.Printf("ok\n")
+  }
+
+  //////////////////////////////////////////////
+
+  fmt.Printf("Checking channel numbers... ")
+
+  numberDupes, numberErr := db.Query("SELECT ch_number, COUNT(*) FROM channels WHERE ch_number IS NOT NULL GROUP BY ch_number HAVING COUNT(*) > 1;")
+  if numberErr != nil {
+    fmt.Printf("ok (no channel numbers)\n")
+  } else {
+    var dupeNumber, dupeNumberCount, numberDupesTotal int64
+
+    for numberDupes.Next() {
+      err = numberDupes.Scan(&dupeNumber, &dupeNumberCount)
+      if err != nil {
+        Bail("SQLite error: %s\n", err.Error())
+      }
+
+      numberDupesTotal += 1
+
+      fmt.Printf("\nWarning: %d channels have the same number %d", dupeNumberCount, dupeNumber)
+    }
+
+    numberDupes.Close()
+
+    if numberDupesTotal != 0 {
+      fmt.Printf("\n")
+    }
+
+    fmt.Printf("ok\n")
+  }
+
+  //////////////////////////////////////////////
+
+  fmt.Printf("Checking integrity of channel_aliases table... ")
+
+  aliasesTableTest := db.QueryRow("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'channel_aliases';")
+  err = aliasesTableTest.Scan(&foobar)
+
+  if err != nil {
+    fmt.Printf("ok (no aliases)\n")
+  } else {
+    var badAliases int64
+
+    invalidAlias := db.QueryRow("SELECT COUNT(*) FROM channel_aliases WHERE NOT EXISTS (SELECT 1 FROM channels WHERE channels.ch_id = channel_aliases.ch_id);")
+    err = invalidAlias.Scan(&badAliases)
+    if err != nil {
+      Bail("Failed to check channel_aliases table:\n %s\n", err.Error())
+    }
+
+    if badAliases != 0 {
+      Bail("Schedule is corrupt: %d channel aliases don't have matching channel in channels table\n", badAliases)
+    }
+
+    ftsChannelsTest := db.QueryRow("SELECT COUNT(*) FROM fts_channels WHERE fts_channels MATCH 'howdy*';")
+    err = ftsChannelsTest.Scan(&foobar)
+    if err != nil {
+      Bail("Failed to query fts_channels table:\n %s\n", err.Error())
+    }
+
+    fmt.Printf("ok\n")
+  }
+
+  //////////////////////////////////////////////
+
+  fmt.Printf("Checking integrity of programme_urls and programme_keywords tables... ")
+
+  linksTableTest := db.QueryRow("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'programme_urls';")
+  err = linksTableTest.Scan(&foobar)
+
+  if err != nil {
+    fmt.Printf("ok (no links)\n")
+  } else {
+    var badUrls, badKeywords int64
+
+    invalidUrl := db.QueryRow("SELECT COUNT(*) FROM programme_urls WHERE NOT EXISTS (SELECT 1 FROM search_meta WHERE search_meta._id = programme_id) OR NOT EXISTS (SELECT 1 FROM uri WHERE uri._id = uri_id);")
+    err = invalidUrl.Scan(&badUrls)
+    if err != nil {
+      Bail("Failed to check programme_urls table:\n %s\n", err.Error())
+    }
+
+    if badUrls != 0 {
+      Bail("Schedule is corrupt: %d programme urls don't have matching programme in search_meta or record in uri table\n", badUrls)
+    }
+
+    invalidKeyword := db.QueryRow("SELECT COUNT(*) FROM programme_keywords WHERE NOT EXISTS (SELECT 1 FROM search_meta WHERE search_meta._id = programme_id) OR NOT EXISTS (SELECT 1 FROM text WHERE docid = keyword_id);")
+    err = invalidKeyword.Scan(&badKeywords)
+    if err != nil {
+      Bail("Failed to check programme_keywords table:\n %s\n", err.Error())
+    }
+
+    if badKeywords != 0 {
+      Bail("Schedule is corrupt: %d programme keywords don't have matching programme in search_meta or text in text table\n", badKeywords)
+    }
+
+    fmt.Printf("ok\n")
+  }
+
+  //////////////////////////////////////////////
+
+  fmt.Printf("Checking integrity of programme_images table... ")
+
+  imagesTableTest := db.QueryRow("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'programme_images';")
+  err = imagesTableTest.Scan(&foobar)
+
+  if err != nil {
+    fmt.Printf("ok (no images)\n")
+  } else {
+    var badImages int64
+
+    invalidImage := db.QueryRow("SELECT COUNT(*) FROM programme_images WHERE NOT EXISTS (SELECT 1 FROM search_meta WHERE search_meta._id = programme_id) OR NOT EXISTS (SELECT 1 FROM uri WHERE uri._id = uri_id);")
+    err = invalidImage.Scan(&badImages)
+    if err != nil {
+      Bail("Failed to check programme_images table:\n %s\n", err.Error())
+    }
+
+    if badImages != 0 {
+      Bail("Schedule is corrupt: %d programme images don't have matching programme in search_meta or record in uri table\n", badImages)
+    }
+
+    fmt.Printf("ok\n")
+  }
+
+  //////////////////////////////////////////////
+
+  fmt.Printf("Checking integrity of translations table... ")
+
+  translationsTableTest := db.QueryRow("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'translations';")
+  err = translationsTableTest.Scan(&foobar)
+
+  if err != nil {
+    fmt.Printf("ok (no translations)\n")
+  } else {
+    var badTranslations int64
+
+    invalidTranslation := db.QueryRow("SELECT COUNT(*) FROM translations WHERE NOT EXISTS (SELECT 1 FROM search_meta WHERE search_meta._id = programme_id) OR (title_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM text WHERE docid = title_id)) OR (sub_title_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM text WHERE docid = sub_title_id)) OR (description_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM text WHERE docid = description_id));")
+    err = invalidTranslation.Scan(&badTranslations)
+    if err != nil {
+      Bail("Failed to check translations table:\n %s\n", err.Error())
+    }
+
+    if badTranslations != 0 {
+      Bail("Schedule is corrupt: %d translations don't have matching programme in search_meta or text in text table\n", badTranslations)
+    }
+
+    fmt.Printf("ok\n")
+  }
+
+  //////////////////////////////////////////////
+
   var chTotal int64
 
   chCount := db.QueryRow("SELECT COUNT(DISTINCT(ch_id)) FROM search_meta;")
@@ -374,7 +658,7 @@ func main() {
 
   err = overall.Scan(&startTs, &endTs)
   if err != nil {
-    Bail("Failed to read start times\n", err.Error())
+    Bail("Failed to read start times\n %s\n", err.Error())
   }
 
   startTime := time.Unix(startTs, 0).In(localLocation)
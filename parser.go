@@ -21,34 +21,160 @@ import (
     "database/sql"
     "encoding/xml"
     "path/filepath"
+    "crypto/sha1"
+    "encoding/hex"
+    "archive/zip"
     "compress/gzip"
+    "compress/bzip2"
     "text/template"
     "mime/multipart"
     "golang.org/x/net/html/charset"
+    "github.com/ulikunitz/xz"
+    "github.com/klauspost/compress/zstd"
 )
 
 import _ "github.com/Alexander-TX/go-sqlite3"
 
 type Channel struct {
- Name                  string             `xml:"display-name"`
+ Names                 []LangText         `xml:"display-name"`
  Id                    string             `xml:"id,attr"`
  Icon                  ImageUri           `xml:"icon"`
+ Lcn                   string             `xml:"lcn"`
+ Urls                  []string           `xml:"url"`
 }
 
 type Programm struct {
  Start                 string             `xml:"start,attr"`
  End                   string             `xml:"stop,attr"`
  Channel               string             `xml:"channel,attr"`
- Title                 string             `xml:"title"`
- Description           string             `xml:"desc"`
- SubTitle              string             `xml:"sub-title"`
+ Titles                []LangText         `xml:"title"`
+ Descriptions          []LangText         `xml:"desc"`
+ SubTitles             []LangText         `xml:"sub-title"`
  Images                []ImageUri         `xml:"icon"`
+ ExtraImages           []Image            `xml:"image"`
  Categories            []string           `xml:"category"`
  Year                  string             `xml:"year"`
+ Credits               Credits            `xml:"credits"`
+ EpisodeNums           []EpisodeNum       `xml:"episode-num"`
+ Ratings               []Rating           `xml:"rating"`
+ Premiere              *LangText          `xml:"premiere"`
+ New                   *struct{}          `xml:"new"`
+ Live                  *struct{}          `xml:"live"`
+ PreviouslyShown       *PreviouslyShown   `xml:"previously-shown"`
+ LastChance            *LangText          `xml:"last-chance"`
+ Video                 Video              `xml:"video"`
+ Audio                 Audio              `xml:"audio"`
+ Subtitles             []Subtitles        `xml:"subtitles"`
+ Countries             []string           `xml:"country"`
+ Language              string             `xml:"language"`
+ OrigLanguage          string             `xml:"orig-language"`
+ Urls                  []ProgrammeUrl     `xml:"url"`
+ Length                Length             `xml:"length"`
+ Keywords              []string           `xml:"keyword"`
+
+ // picked from all languages according to -lang
+ Title                 string             `xml:"-"`
+ Description           string             `xml:"-"`
+ SubTitle              string             `xml:"-"`
+
+ // parsed from <episode-num>, 1-based (-1 if unknown, 0 for specials like S00),
+ // totals are 0 if unknown
+ Season                int                `xml:"-"`
+ SeasonTotal           int                `xml:"-"`
+ Episode               int                `xml:"-"`
+ EpisodeTotal          int                `xml:"-"`
+ Part                  int                `xml:"-"`
+ PartTotal             int                `xml:"-"`
+
+ // minimal age from <rating> and title suffix (-1 if unknown)
+ AgeRating             int                `xml:"-"`
+}
+
+type LangText struct {
+ Lang                  string             `xml:"lang,attr"`
+ Text                  string             `xml:",chardata"`
+}
+
+type ProgrammeUrl struct {
+ System                string             `xml:"system,attr"`
+ Uri                   string             `xml:",chardata"`
+}
+
+type Length struct {
+ Units                 string             `xml:"units,attr"`
+ Value                 string             `xml:",chardata"`
+}
+
+type Video struct {
+ Present               string             `xml:"present"`
+ Colour                string             `xml:"colour"`
+ Aspect                string             `xml:"aspect"`
+ Quality               string             `xml:"quality"`
+}
+
+type Audio struct {
+ Present               string             `xml:"present"`
+ Stereo                string             `xml:"stereo"`
+}
+
+type Subtitles struct {
+ Type                  string             `xml:"type,attr"`
+}
+
+type PreviouslyShown struct {
+ Start                 string             `xml:"start,attr"`
+ Channel               string             `xml:"channel,attr"`
+}
+
+type Rating struct {
+ System                string             `xml:"system,attr"`
+ Value                 string             `xml:"value"`
+}
+
+type EpisodeNum struct {
+ System                string             `xml:"system,attr"`
+ Value                 string             `xml:",chardata"`
+}
+
+type Credits struct {
+ Directors             []string           `xml:"director"`
+ Actors                []Actor            `xml:"actor"`
+ Writers               []string           `xml:"writer"`
+ Adapters              []string           `xml:"adapter"`
+ Producers             []string           `xml:"producer"`
+ Composers             []string           `xml:"composer"`
+ Editors               []string           `xml:"editor"`
+ Presenters            []string           `xml:"presenter"`
+ Commentators          []string           `xml:"commentator"`
+ Guests                []string           `xml:"guest"`
+}
+
+type Actor struct {
+ Name                  string             `xml:",chardata"`
+ Role                  string             `xml:"role,attr"`
 }
 
 type ImageUri struct {
   Uri                  string             `xml:"src,attr"`
+  Width                string             `xml:"width,attr"`
+  Height               string             `xml:"height,attr"`
+}
+
+type Image struct {
+  Type                 string             `xml:"type,attr"`
+  Orient               string             `xml:"orient,attr"`
+  Size                 string             `xml:"size,attr"`
+  Uri                  string             `xml:",chardata"`
+}
+
+type GenreMeta struct {
+  Genre                string
+  ContentNibble        int
+}
+
+type MetaColumn struct {
+  Name                 string
+  Type                 string
 }
 
 type ChannelMeta struct {
@@ -56,17 +182,20 @@ type ChannelMeta struct {
   ArchiveHours         int
   ImageUrlOverride     string
   ChannelPage          string
-  TimeOffsetHours      int
+  TimeOffset           time.Duration
+  TimeZone             *time.Location
+  ChannelNumber        int
 }
 
 type TagMeta struct {
   NumberOfUses         int64
   IdVal                int64
+  ListId               int64
 }
 
 type EndMeta struct {
   StartTime            int64
-  EndTime              string
+  EndTime              sql.NullInt64
 }
 
 type Track struct {
@@ -75,17 +204,57 @@ type Track struct {
   ChannelPage          string             `xml:"subscribe"`
   Title                string             `xml:"title"`
   Image                string             `xml:"image"`
+  Number               int                `xml:"trackNum"`
+}
+
+type SourceSlot struct {
+  ChId                 string
+  Source               int
+  StartTime            int64
+}
+
+type ScannedSlot struct {
+  Source               int
+  StartTime            int64
+  EndTime              sql.NullInt64
+  HasDescription       bool
+  HasImage             bool
+}
+
+type SourceScore struct {
+  Source               int
+  Days                 float64
+  DescriptionShare     float64
+  ImageShare           float64
+  Problems             int
+  Score                float64
+}
+
+type SourceSpan struct {
+  Source               int
+  StartTime            int64
+  EndTime              int64
+}
+
+type ProgrammeSlot struct {
+  Start                string             `xml:"start,attr"`
+  End                  string             `xml:"stop,attr"`
+  Channel              string             `xml:"channel,attr"`
+  Descriptions         []LangText         `xml:"desc"`
+  Images               []ImageUri         `xml:"icon"`
+  ExtraImages          []Image            `xml:"image"`
 }
 
 type RequestContext struct {
-  sql1, sql2, sql3, sql4, sql5, sql6, sql7 *sql.Stmt
+  sql1, sql2, sql3, sql4, sql5, sql6, sql7, sql8, sql9, sql10, sql11, sql12, sql13, sql14, sql15, sql16, sql17 *sql.Stmt
   db *sql.DB
   stringMap map[string]int64
   uriMap map[string]int64
+  aliasMap map[string]struct{}
   tagMap map[string]*TagMeta
   endMap map[string]*EndMeta
-  bgnMap map[string]*EndMeta
-  limits map[string][2]int64
+  lastStarts map[string]int64
+  source int
   uriIdMax, textIdMax int64
   appendedElements, appendedChannels int
 }
@@ -118,22 +287,199 @@ var compiledTemplate *template.Template
 var ageRegexp *regexp.Regexp
 var timeRegexp1 *regexp.Regexp
 var yearRegexp1 *regexp.Regexp
+var onscreenRegexp1 *regexp.Regexp
+var onscreenRegexp2 *regexp.Regexp
+var onscreenRegexp3 *regexp.Regexp
+var onscreenRegexp4 *regexp.Regexp
+var ratingRegexp1 *regexp.Regexp
+
+// columns of search_meta, that are always present after mandatory and optional ones
+var extraMetaCols = []MetaColumn{
+  { "season", "INTEGER" },
+  { "season_total", "INTEGER" },
+  { "episode", "INTEGER" },
+  { "episode_total", "INTEGER" },
+  { "part", "INTEGER" },
+  { "part_total", "INTEGER" },
+  { "age_rating", "INTEGER" },
+  { "adult", "INTEGER NOT NULL DEFAULT 0" },
+  { "end_time", "INTEGER" },
+  { "flags", "INTEGER NOT NULL DEFAULT 0" },
+  { "video_quality", "INTEGER" },
+  { "aspect_ratio", "TEXT" },
+  { "colour", "INTEGER" },
+  { "audio", "INTEGER" },
+  { "subtitles", "INTEGER NOT NULL DEFAULT 0" },
+  { "country", "TEXT" },
+  { "language", "TEXT" },
+  { "orig_language", "TEXT" },
+  { "length", "INTEGER" },
+  { "content_nibble", "INTEGER" },
+  { "title_lang", "TEXT" },
+}
+
+// ISO 3166-1 alpha-2 codes for country names, commonly found in XMLTV (lowercase);
+// withdrawn codes and former countries are mapped to their successor states
+var countryCodes = map[string]string{
+  "su": "RU", "dd": "DE", "yu": "RS",
+  "russia": "RU", "russian federation": "RU", "россия": "RU", "рф": "RU", "ссср": "RU", "ussr": "RU", "soviet union": "RU",
+  "usa": "US", "united states": "US", "united states of america": "US", "сша": "US",
+  "uk": "GB", "united kingdom": "GB", "great britain": "GB", "england": "GB", "великобритания": "GB", "англия": "GB",
+  "france": "FR", "франция": "FR", "germany": "DE", "германия": "DE", "фрг": "DE", "гдр": "DE",
+  "italy": "IT", "италия": "IT", "spain": "ES", "испания": "ES", "canada": "CA", "канада": "CA",
+  "australia": "AU", "австралия": "AU", "japan": "JP", "япония": "JP", "china": "CN", "китай": "CN",
+  "south korea": "KR", "korea": "KR", "республика корея": "KR", "южная корея": "KR", "корея южная": "KR",
+  "india": "IN", "индия": "IN", "ukraine": "UA", "украина": "UA", "belarus": "BY", "беларусь": "BY", "белоруссия": "BY",
+  "kazakhstan": "KZ", "казахстан": "KZ", "poland": "PL", "польша": "PL", "czech republic": "CZ", "czechia": "CZ", "чехия": "CZ",
+  "sweden": "SE", "швеция": "SE", "norway": "NO", "норвегия": "NO", "denmark": "DK", "дания": "DK", "finland": "FI", "финляндия": "FI",
+  "netherlands": "NL", "нидерланды": "NL", "голландия": "NL", "belgium": "BE", "бельгия": "BE", "switzerland": "CH", "швейцария": "CH",
+  "austria": "AT", "австрия": "AT", "ireland": "IE", "ирландия": "IE", "mexico": "MX", "мексика": "MX", "brazil": "BR", "бразилия": "BR",
+  "argentina": "AR", "аргентина": "AR", "turkey": "TR", "турция": "TR", "israel": "IL", "израиль": "IL", "new zealand": "NZ", "новая зеландия": "NZ",
+  "hong kong": "HK", "гонконг": "HK", "taiwan": "TW", "тайвань": "TW", "hungary": "HU", "венгрия": "HU", "romania": "RO", "румыния": "RO",
+  "bulgaria": "BG", "болгария": "BG", "greece": "GR", "греция": "GR", "portugal": "PT", "португалия": "PT", "georgia": "GE", "грузия": "GE",
+  "armenia": "AM", "армения": "AM", "azerbaijan": "AZ", "азербайджан": "AZ", "uzbekistan": "UZ", "узбекистан": "UZ",
+  "latvia": "LV", "латвия": "LV", "lithuania": "LT", "литва": "LT", "estonia": "EE", "эстония": "EE",
+  "serbia": "RS", "сербия": "RS", "yugoslavia": "RS", "югославия": "RS", "south africa": "ZA", "юар": "ZA", "egypt": "EG", "египет": "EG",
+  "iran": "IR", "иран": "IR", "thailand": "TH", "таиланд": "TH", "iceland": "IS", "исландия": "IS",
+  "rus": "RU", "gbr": "GB", "fra": "FR", "deu": "DE", "ita": "IT", "esp": "ES", "can": "CA", "aus": "AU", "jpn": "JP", "chn": "CN", "kor": "KR", "ind": "IN", "ukr": "UA", "blr": "BY", "kaz": "KZ",
+}
+
+// ISO 639-1 codes for language names, commonly found in XMLTV (lowercase)
+var languageCodes = map[string]string{
+  "russian": "ru", "русский": "ru", "рус": "ru", "rus": "ru", "english": "en", "английский": "en", "eng": "en",
+  "german": "de", "немецкий": "de", "deu": "de", "ger": "de", "french": "fr", "французский": "fr", "fra": "fr", "fre": "fr",
+  "spanish": "es", "испанский": "es", "spa": "es", "italian": "it", "итальянский": "it", "ita": "it",
+  "ukrainian": "uk", "украинский": "uk", "ukr": "uk", "belarusian": "be", "белорусский": "be", "bel": "be",
+  "kazakh": "kk", "казахский": "kk", "kaz": "kk", "tatar": "tt", "татарский": "tt", "tat": "tt",
+  "japanese": "ja", "японский": "ja", "jpn": "ja", "chinese": "zh", "китайский": "zh", "zho": "zh", "chi": "zh",
+  "korean": "ko", "корейский": "ko", "kor": "ko", "polish": "pl", "польский": "pl", "pol": "pl",
+  "czech": "cs", "чешский": "cs", "ces": "cs", "cze": "cs", "swedish": "sv", "шведский": "sv", "swe": "sv",
+  "finnish": "fi", "финский": "fi", "fin": "fi", "dutch": "nl", "голландский": "nl", "нидерландский": "nl", "nld": "nl", "dut": "nl",
+  "portuguese": "pt", "португальский": "pt", "por": "pt", "turkish": "tr", "турецкий": "tr", "tur": "tr",
+  "arabic": "ar", "арабский": "ar", "ara": "ar", "hebrew": "he", "иврит": "he", "heb": "he", "hindi": "hi", "хинди": "hi", "hin": "hi",
+  "greek": "el", "греческий": "el", "ell": "el", "gre": "el", "hungarian": "hu", "венгерский": "hu", "hun": "hu",
+  "georgian": "ka", "грузинский": "ka", "kat": "ka", "geo": "ka", "armenian": "hy", "армянский": "hy", "hye": "hy", "arm": "hy",
+  "latvian": "lv", "латышский": "lv", "lav": "lv", "lithuanian": "lt", "литовский": "lt", "lit": "lt", "estonian": "et", "эстонский": "et", "est": "et",
+}
+
+// values of video_quality column
+const (
+  QualitySD            = 0
+  QualityHD            = 1
+  QualityUHD           = 2
+)
+
+// values of audio column
+const (
+  AudioNone            = 0
+  AudioMono            = 1
+  AudioStereo          = 2
+  AudioDolby           = 3
+  AudioDolbyDigital    = 4
+  AudioBilingual       = 5
+  AudioSurround        = 6
+)
+
+// values of subtitles column, one bit per type
+const (
+  SubtitlesTeletext    = 1 << iota
+  SubtitlesOnscreen
+  SubtitlesDeafSigned
+)
+
+// values of flags column, one bit per flag (same as in tags table)
+const (
+  FlagPremiere         = 1 << iota
+  FlagNew
+  FlagLive
+  FlagPreviouslyShown
+  FlagLastChance
+  FlagNoVideo
+)
+
+var flagNames = []struct {
+  IdVal                int64
+  Name                 string
+}{
+  { FlagPremiere, "premiere" },
+  { FlagNew, "new" },
+  { FlagLive, "live" },
+  { FlagPreviouslyShown, "previously-shown" },
+  { FlagLastChance, "last-chance" },
+  { FlagNoVideo, "no-video" },
+}
 
 var excludeYear bool
 var excludeTags bool
+var allTags bool
 var ignoreXspfErrors bool
 
 var mappedTotal = 0
 var trimmedTotal = 0
+var badEpisodeNums = 0
+var badStopTimes = 0
+var badStartTimes = 0
+var dstAdjustments []string
+
+var unknownCountries = make(map[string]int)
+var unknownLanguages = make(map[string]int)
 var snippetLengthMax = 0
 var dvrLength = 0
 
 var channelBlacklist, channelWhitelist map[string]struct{}
 
+var categoryMap map[string]GenreMeta
+
+var sourceNames []string
+var sourcePriority []int
+var sourceAuto bool
+var sourceScores map[string][]SourceScore
+var channelOrders map[string][]int
+
+var enrichProgrammes bool
+var enrichWindow time.Duration
+var enrichedSlots = make(map[string]int)
+var channelPriorities = make(map[string][]int)
+var acceptedSlots map[SourceSlot]struct{}
+var sourceSpans map[string][]SourceSpan
+
+var duplicatePolicy string
+var overlapPolicy string
+var gapFillerLength time.Duration
+var gapFillerText string
+var overlapSlots = make(map[string]int)
+var gapSlots = make(map[string]int)
+var duplicateSlots = make(map[string]int)
+
+var tagRegistryFile string
+var tagRegistry = make(map[string]int)
+var tagRegistryChanged bool
+var unmappedCategories = make(map[string]int)
+
 var archivedChannels = 0
 
+var langPrefs []string
+var storeTranslations bool
+
+var httpCacheDir string
+var httpTimeout time.Duration
+var httpRetries int
+var httpRetryDelay = 5 * time.Second
+var tempSources []string
+
 var exitCode = 0
 
+func compileRegexps() {
+  ageRegexp = regexp.MustCompile("^(.*?)\\s*[\\(\\[]([0-9]{1,2})\\+[\\)\\]]$")
+  ratingRegexp1 = regexp.MustCompile("([0-9]{1,2})")
+  timeRegexp1 = regexp.MustCompile("^\\s*([0-9]{4}(?:[0-9]{2}){0,5})\\s*((?i:Z|UTC|GMT)|[+-][0-9]{2}(?::?[0-9]{2})?)?\\s*$")
+  yearRegexp1 = regexp.MustCompile("([0-9]{4})$")
+  onscreenRegexp1 = regexp.MustCompile("(?i)^s\\s*([0-9]+)\\s*[ .:-]?\\s*e\\s*([0-9]+)")
+  onscreenRegexp2 = regexp.MustCompile("^([0-9]+)\\s*x\\s*([0-9]+)$")
+  onscreenRegexp3 = regexp.MustCompile("(?i)(?:^|[^a-zа-я])(?:сезон|season)\\s*([0-9]+)|([0-9]+)\\s*(?:-?й\\s*)?(?:сезон|season)")
+  onscreenRegexp4 = regexp.MustCompile("(?i)(?:^|[^a-zа-я])(?:серия|эпизод|episode|ep\\.?|e)\\s*([0-9]+)|([0-9]+)\\s*(?:-?я\\s*)?(?:серия|эпизод|episode)")
+}
+
 func Bail(format string, a ...interface{}) {
   exitCode = 1
   fmt.Fprintf(os.Stderr, "%s\n", "Fatal error!!")
@@ -158,25 +504,41 @@ func main() {
   defDuration, _ := time.ParseDuration("72h")
 
   dbPath := flag.String("output", "schedule.epgx.gz", "database file.")
-  xmlPath := flag.String("input", "", "Paths to one or more XMLTV file(s), comma-separated. (default read from standard input)")
+  xmlPath := flag.String("input", "", "Paths to one or more XMLTV file(s), comma-separated. Compressed files (gzip, xz, bzip2, zstd, zip) are unpacked automatically. (default read from standard input)")
   timeStart := flag.String("offset", "01-01-1970 00:00", "start import from specified date. Example: 29-12-2009 16:40.")
   argDuration := flag.Duration("timespan", defDuration, "duration since start date. Example: 72h.")
   flag.IntVar(&snippetLength, "snippet", -1, "description length limit. If negative, descriptions aren't clipped.")
-  nameMapFile := flag.String("xmap", "", "Optional: file with pipe-separated ID mappings. (default none)")
-  xspfFile := flag.String("xspf", "", "Optional: playlist with proprietary Eltex extensions (<psfile> and <archive_limit> tags). (default none)")
-  xmltvTz := flag.String("tz", "", "Optional: replace timezone in XMLTV file. Example: 'Asia/Novosibirsk'. (default none)")
+  nameMapFile := flag.String("xmap", "", "Optional: file with pipe-separated ID mappings (name|id|archive hours|image|page|time offset: hours, minutes with 'm' suffix or IANA zone|channel number|source priority). (default none)")
+  sourcePriorityList := flag.String("source-priority", "", "Optional: comma-separated numbers of -input files, from the most trusted to the least trusted ones; less trusted files only fill gaps in more trusted ones. 'auto' orders files for each channel by coverage and quality of data. (default order of -input)")
+  categoryMapFile := flag.String("category-map", "", "Optional: file with pipe-separated category mappings (category|genre|ETSI EN 300 468 content nibble, hex). (default none)")
+  xspfFile := flag.String("xspf", "", "Optional: playlist with proprietary Eltex extensions (<psfile> and <archive_limit> tags), <trackNum> overrides channel number. (default none)")
+  xmltvTz := flag.String("tz", "", "Optional: replace timezone in XMLTV file, explicit offsets in dates are ignored. Example: 'Asia/Novosibirsk'. (default none)")
   flag.BoolVar(&useLegacyFormat, "legacy", true, "Deprecated: this option does nothing")
   includeCh := flag.String("include", "", "Optional: comma-separated list of channels to include in generated EPG.")
   excludeCh := flag.String("exclude", "", "Optional: comma-separated list of channels to exclude from generated EPG.")
   flag.BoolVar(&startServer, "start-server", false, "Start web server, listening on :9448")
-  fakeEnd = flag.String("add-last-entry", "Конец передачи", "text of fake entry, denoting end of program. Empty string to disable")
-  titleTemplate := flag.String("title-template", "{{.Title}}", "Supported variables: .Title, .SubTitle, .Description")
+  fakeEnd = flag.String("add-last-entry", "Конец передачи", "text of fake entry, denoting end of program. Empty string to disable (end of each programme is also stored in end_time column)")
+  titleTemplate := flag.String("title-template", "{{.Title}}", "Supported variables: .Title, .SubTitle, .Description, .Season, .SeasonTotal, .Episode, .EpisodeTotal, .Part, .PartTotal, .AgeRating, .Premiere, .New, .Live, .PreviouslyShown, .LastChance")
   imageBase := flag.String("rewrite-url", "", "Optional: replace base URL of EPG images with specified")
   showVersion := flag.Bool("version", false, "Write version information to standard output")
   omitYear := flag.Bool("exclude-year", false, "Exclude optional year data from generated EPG")
   omitTags := flag.Bool("exclude-tags", false, "Exclude optional tags data from generated EPG")
+  flag.BoolVar(&enrichProgrammes, "enrich", false, "Fill missing descriptions, images and years of programmes from matching programmes in other -input files")
+  flag.DurationVar(&enrichWindow, "enrich-window", 15 * time.Minute, "Max difference between start times of matching programmes for -enrich")
+  flag.StringVar(&duplicatePolicy, "duplicates", "fail", "What to do with programmes, starting at the same time on the same channel: fail, first (keep first one), last (keep last one), longest (keep the longest one), merge (fill missing data of first one from others)")
+  flag.StringVar(&overlapPolicy, "overlaps", "keep", "What to do with overlapping programmes on the same channel: keep (keep both), trim (cut the end of earlier one), drop-shorter (remove the shorter one)")
+  flag.DurationVar(&gapFillerLength, "fill-gaps", 0, "Optional: fill gaps between programmes, longer than specified duration, with placeholder entries. Example: 30m. (default none)")
+  flag.StringVar(&gapFillerText, "gap-text", "Нет информации", "text of placeholder entries, added by -fill-gaps")
+  flag.StringVar(&tagRegistryFile, "tag-registry", "", "Optional: file with pipe-separated tag bits (bit|tag), read and updated on each run to keep bits of tags stable. (default none)")
+  flag.BoolVar(&allTags, "all-tags", false, "Store all tags in tag_list and programme_tags tables, in addition to 63 most popular ones in tags bitmask")
   ignoreXspfConflicts := flag.Bool("xspf-ignore-conflicts", false, "Import only new channels from XSPF, ignore conflicts")
   setArchiveLength := flag.Int("dvr-length", 0, "Set default length of DVR archive, in hours")
+  flag.StringVar(&httpCacheDir, "cache-dir", "", "Optional: directory for caching XMLTV files, downloaded over HTTP(S). (default none)")
+  flag.DurationVar(&httpTimeout, "http-timeout", 5 * time.Minute, "Timeout for downloading each XMLTV file over HTTP(S)")
+  flag.IntVar(&httpRetries, "http-retries", 3, "Number of retries for failed HTTP(S) downloads")
+  preferredLangs := flag.String("lang", "", "Optional: comma-separated list of preferred languages for titles and descriptions. Example: ru,en. (default first one in XMLTV)")
+  flag.BoolVar(&storeTranslations, "translations", false, "Store titles and descriptions in other languages to translations table")
+  skipUnchanged := flag.Bool("skip-unchanged", false, "Do not rebuild output if none of input files changed since it was written")
   flag.Parse()
 
   if flag.NArg() != 0 {
@@ -207,6 +569,29 @@ func main() {
 
   //fmt.Printf(" exclude year = %t\n exclude tags = %t\n", excludeYear, excludeTags)
 
+  switch duplicatePolicy {
+    case "fail", "first", "last", "longest", "merge":
+    default:
+      Bail("Unknown duplicates policy: %s\n", duplicatePolicy)
+  }
+
+  if *sourcePriorityList == "auto" {
+    sourceAuto = true
+  } else if *sourcePriorityList != "" {
+    var priorityErr error
+
+    sourcePriority, priorityErr = parseSourceList(*sourcePriorityList)
+    if priorityErr != nil {
+      Bail("Bad -source-priority value: %s\n %s\n", *sourcePriorityList, priorityErr.Error())
+    }
+  }
+
+  switch overlapPolicy {
+    case "keep", "trim", "drop-shorter":
+    default:
+      Bail("Unknown overlaps policy: %s\n", overlapPolicy)
+  }
+
   if *showVersion {
     fmt.Printf("%s\n", EltexPackageVersion)
     os.Exit(0)
@@ -263,9 +648,7 @@ func main() {
     }
   }
 
-  ageRegexp = regexp.MustCompile("(.+)\\([0-9]{1,2}\\+\\)$")
-  timeRegexp1 = regexp.MustCompile("([0-9]{14})( (?:.+))?$")
-  yearRegexp1 = regexp.MustCompile("([0-9]{4})$")
+  compileRegexps()
 
   if startServer {
     bootstrapServer()
@@ -291,6 +674,16 @@ func main() {
     fmt.Fprintf(os.Stderr, "Warning: missing --timespan argument, EPG length defaults to 74 hours\n")
   }
 
+  if *preferredLangs != "" {
+    for _, lang := range strings.Split(*preferredLangs, ",") {
+      lang = strings.ToLower(strings.TrimSpace(lang))
+
+      if lang != "" {
+        langPrefs = append(langPrefs, lang)
+      }
+    }
+  }
+
   if seen["include"] {
     if len(*includeCh) == 0 {
       Bail("Bad --include argument: must contain at least one channel ID\n")
@@ -361,7 +754,9 @@ func main() {
         hours := 0
         chImage := ""
         chPage := ""
-        chOffset := 0
+        var chOffset time.Duration
+        var chZone *time.Location
+        chNumber := 0
 
         if len(sepIdx) > 2 {
           hours, _ = strconv.Atoi(sepIdx[2])
@@ -376,7 +771,25 @@ func main() {
         }
 
         if len(sepIdx) > 5 {
-          chOffset, _ = strconv.Atoi(sepIdx[5])
+          var offsetErr error
+
+          chOffset, chZone, offsetErr = parseChannelOffset(sepIdx[5])
+          if offsetErr != nil {
+            Bail("Failed to parse map file. Bad time offset at line %d:\n%s\n %s\n", lineNum, mapRule, offsetErr.Error())
+          }
+        }
+
+        if len(sepIdx) > 6 {
+          chNumber, _ = strconv.Atoi(sepIdx[6])
+        }
+
+        if len(sepIdx) > 7 && sepIdx[7] != "" {
+          var priorityErr error
+
+          channelPriorities[mapNam], priorityErr = parseSourceList(sepIdx[7])
+          if priorityErr != nil {
+            Bail("Failed to parse map file. Bad source priority at line %d:\n%s\n %s\n", lineNum, mapRule, priorityErr.Error())
+          }
         }
 
         idMap[mapId] = ChannelMeta{
@@ -384,7 +797,9 @@ func main() {
           ArchiveHours: hours,
           ImageUrlOverride: chImage,
           ChannelPage: chPage,
-          TimeOffsetHours: chOffset,
+          TimeOffset: chOffset,
+          TimeZone: chZone,
+          ChannelNumber: chNumber,
         }
       }
 
@@ -402,30 +817,40 @@ func main() {
     fmt.Printf("Parsed %d mappings\n", lineNum)
   }
 
-  outDir := filepath.Dir(*dbPath)
-
-  tmpFile, tmpErr := ioutil.TempFile(outDir, "db-*.sqlite")
-  if tmpErr != nil {
-    Bail("Cannot create temporary file\n %s\n", tmpErr.Error())
+  if (*categoryMapFile != "") {
+    loadCategoryMap(*categoryMapFile)
   }
 
-  defer os.Remove(tmpFile.Name())
-
-  dbUrl := fmt.Sprintf("file:%s", tmpFile.Name())
-
-  db, dbErr := sql.Open("sqlite3", dbUrl)
-  if dbErr != nil {
-    Bail("sqlite error\n %s\n", dbErr.Error())
+  if (tagRegistryFile != "") {
+    loadTagRegistry(tagRegistryFile)
   }
 
+  defer func() {
+    for _, tempSource := range tempSources {
+      os.Remove(tempSource)
+    }
+  }()
+
   var xmlFile []io.Reader
 
+  // reading from stdin always means rebuild, we can't know what is in there
+  sourcesChanged := *xmlPath == ""
+
   if (*xmlPath == "") {
     fmt.Printf("No -input argument, reading from standard input...\n");
 
+    stdinReader, stdinErr := decompressXmltv("standard input", os.Stdin)
+    if stdinErr != nil {
+      Bail("Could not read XMLTV from standard input\n %s\n", stdinErr.Error())
+    }
+
     xmlFile = make([]io.Reader, 1)
 
-    xmlFile[0] = bufio.NewReader(os.Stdin)
+    xmlFile[0] = stdinReader
+
+    sourceNames = []string{ "standard input" }
+
+    checkSourceLists()
   } else {
     var inputErr error
 
@@ -434,6 +859,10 @@ func main() {
     })
 
     xmlFile = make([]io.Reader, len(inputList))
+    sourceNames = inputList
+
+    checkSourceLists()
+    sourcePaths := make([]string, len(inputList))
 
     for pos, path := range inputList {
       if path == "" {
@@ -442,23 +871,73 @@ func main() {
 
       fmt.Printf("Opening %s\n", path)
 
-      xmlFile[pos], inputErr = os.Open(path)
+      if isHttpSource(path) {
+        path, inputErr = fetchXmltv(path)
+        if inputErr != nil {
+          Bail("Could not download XMLTV file\n %s\n", inputErr.Error())
+        }
+      }
+
+      // files in HTTP cache keep their timestamps, unless the server sent a new version
+      if !isOlderThan(path, *dbPath) {
+        sourcesChanged = true
+      }
+
+      xmlFile[pos], inputErr = openXmltv(path)
       if inputErr != nil {
         Bail("Could not open XMLTV file\n %s\n", inputErr.Error())
       }
+
+      sourcePaths[pos] = path
+    }
+
+    if len(sourcePaths) > 1 {
+      // programmes of all files have to be known in advance to decide, which
+      // of them fill gaps in more trusted files, so the files are read twice
+      scanned := make(map[string][]ScannedSlot)
+
+      for pos, path := range sourcePaths {
+        scanErr := scanSource(path, pos, scanned)
+        if scanErr != nil {
+          Bail("%s\n", scanErr.Error())
+        }
+      }
+
+      resolveSources(scanned)
     }
   }
 
+  if *skipUnchanged && !sourcesChanged && isOlderThan(*nameMapFile, *dbPath) && isOlderThan(*xspfFile, *dbPath) &&
+      isOlderThan(*categoryMapFile, *dbPath) && isOlderThan(tagRegistryFile, *dbPath) {
+    fmt.Printf("None of sources changed since %s was written, skipping rebuild\n", *dbPath)
+    return
+  }
+
+  outDir := filepath.Dir(*dbPath)
+
+  tmpFile, tmpErr := ioutil.TempFile(outDir, "db-*.sqlite")
+  if tmpErr != nil {
+    Bail("Cannot create temporary file\n %s\n", tmpErr.Error())
+  }
+
+  defer os.Remove(tmpFile.Name())
+
+  dbUrl := fmt.Sprintf("file:%s", tmpFile.Name())
+
+  db, dbErr := sql.Open("sqlite3", dbUrl)
+  if dbErr != nil {
+    Bail("sqlite error\n %s\n", dbErr.Error())
+  }
+
   ctx := RequestContext{}
 
   ctx.db = db
 
   ctx.stringMap = make(map[string]int64)
   ctx.uriMap = make(map[string]int64)
+  ctx.aliasMap = make(map[string]struct{})
   ctx.tagMap = make(map[string]*TagMeta)
   ctx.endMap = make(map[string]*EndMeta)
-  ctx.bgnMap = make(map[string]*EndMeta)
-  ctx.limits = make(map[string][2]int64)
 
   ctx.textIdMax = 1
   ctx.uriIdMax = 1
@@ -468,7 +947,9 @@ func main() {
     Bail("%s\n", initErr.Error())
   }
 
-  for _, xml := range xmlFile {
+  for pos, xml := range xmlFile {
+    ctx.source = pos
+
     reqErr := processXml(&ctx, "main", xml)
     if reqErr != nil {
       Bail("%s\n", reqErr.Error())
@@ -515,6 +996,226 @@ func main() {
   }
 
   fmt.Printf("EPG was successfully written to %s\n", *dbPath)
+
+  // bits of new tags are remembered only after they've made it into EPG; the registry
+  // is not rewritten needlessly, because -skip-unchanged compares its timestamp too
+  if tagRegistryFile != "" && tagRegistryChanged && !excludeTags {
+    registryErr := saveTagRegistry(tagRegistryFile)
+    if registryErr != nil {
+      Bail("%s\n", registryErr.Error())
+    }
+  }
+}
+
+func loadCategoryMap(categoryMapFilename string) {
+  categoryMap = make(map[string]GenreMeta)
+
+  catMap, catMapErr := os.Open(categoryMapFilename)
+  if catMapErr != nil {
+    Bail("Failed to open category map file:\n %s\n", catMapErr.Error())
+  }
+
+  mapReader := bufio.NewReader(catMap)
+
+  lineNum := 0
+  for {
+    mapRule, lineErr := mapReader.ReadString('\n')
+
+    if strings.TrimSpace(mapRule) != "" && !strings.HasPrefix(mapRule, "#") {
+      mapRule = strings.TrimSpace(mapRule)
+
+      lineNum += 1
+
+      sepIdx := strings.Split(mapRule, "|")
+
+      if len(sepIdx) < 2 {
+        Bail("Failed to parse category map file. Bad format at line %d: the line does not contain pipe ('|')\n%s\n", lineNum, mapRule)
+      }
+
+      rawCategory := strings.ToLower(strings.TrimSpace(sepIdx[0]))
+      genre := strings.TrimSpace(sepIdx[1])
+
+      if len(rawCategory) == 0 || len(genre) == 0 {
+        Bail("Failed to parse category map file. Bad format at line %d: category or genre is missing:\n%s\n", lineNum, mapRule)
+      }
+
+      nibble := 0
+
+      if len(sepIdx) > 2 && strings.TrimSpace(sepIdx[2]) != "" {
+        parsedNibble, nibbleErr := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(sepIdx[2]), "0x"), 16, 8)
+        if nibbleErr != nil {
+          Bail("Failed to parse category map file. Bad content nibble at line %d:\n%s\n", lineNum, mapRule)
+        }
+
+        nibble = int(parsedNibble)
+      }
+
+      categoryMap[rawCategory] = GenreMeta{
+        Genre: genre,
+        ContentNibble: nibble,
+      }
+    }
+
+    if lineErr != nil {
+      if lineErr == io.EOF {
+        break;
+      }
+
+      Bail("Received IO error during reading category map file:\n %s\n", lineErr.Error())
+    }
+  }
+
+  catMap.Close()
+
+  fmt.Printf("Parsed %d category mappings\n", lineNum)
+}
+
+func loadTagRegistry(registryFilename string) {
+  registry, registryErr := os.Open(registryFilename)
+  if registryErr != nil {
+    if os.IsNotExist(registryErr) {
+      // first run, the file will be created after EPG is written
+      tagRegistryChanged = true
+      return
+    }
+
+    Bail("Failed to open tag registry file:\n %s\n", registryErr.Error())
+  }
+
+  registryReader := bufio.NewReader(registry)
+
+  usedBits := make(map[int]string)
+
+  lineNum := 0
+  for {
+    registryLine, lineErr := registryReader.ReadString('\n')
+
+    if strings.TrimSpace(registryLine) != "" && !strings.HasPrefix(registryLine, "#") {
+      registryLine = strings.TrimRight(registryLine, "\r\n")
+
+      lineNum += 1
+
+      sepIdx := strings.SplitN(registryLine, "|", 2)
+
+      if len(sepIdx) == 2 {
+        sepIdx[1] = strings.TrimSpace(sepIdx[1])
+      }
+
+      if len(sepIdx) < 2 || sepIdx[1] == "" {
+        Bail("Failed to parse tag registry file. Bad format at line %d: expected bit|tag\n%s\n", lineNum, registryLine)
+      }
+
+      bit, bitErr := strconv.Atoi(strings.TrimSpace(sepIdx[0]))
+      if bitErr != nil || bit < 0 || bit > 62 {
+        Bail("Failed to parse tag registry file. Bad bit number at line %d (must be 0-62):\n%s\n", lineNum, registryLine)
+      }
+
+      if otherTag, dupe := usedBits[bit]; dupe {
+        Bail("Failed to parse tag registry file. Bit %d at line %d is already used by '%s'\n", bit, lineNum, otherTag)
+      }
+
+      usedBits[bit] = sepIdx[1]
+      tagRegistry[sepIdx[1]] = bit
+    }
+
+    if lineErr != nil {
+      if lineErr == io.EOF {
+        break;
+      }
+
+      Bail("Received IO error during reading tag registry file:\n %s\n", lineErr.Error())
+    }
+  }
+
+  registry.Close()
+
+  fmt.Printf("Parsed %d registered tags\n", lineNum)
+}
+
+func saveTagRegistry(registryFilename string) error {
+  registryTags := make([]string, 0, len(tagRegistry))
+
+  for tag, _ := range tagRegistry {
+    registryTags = append(registryTags, tag)
+  }
+
+  sort.Slice(registryTags, func(i, j int) bool {
+    return tagRegistry[registryTags[i]] < tagRegistry[registryTags[j]]
+  })
+
+  // write to temporary file first, so that interrupted run does not leave broken registry
+  tempRegistry, tempErr := ioutil.TempFile(filepath.Dir(registryFilename), ".tags")
+  if tempErr != nil {
+    return errors.New(s("Failed to create tag registry file\n %s\n", tempErr.Error()))
+  }
+
+  registryWriter := bufio.NewWriter(tempRegistry)
+
+  fmt.Fprintf(registryWriter, "# bit|tag, generated by parser, bits of existing tags must not be changed\n")
+
+  for _, tag := range registryTags {
+    fmt.Fprintf(registryWriter, "%d|%s\n", tagRegistry[tag], tag)
+  }
+
+  writeErr := registryWriter.Flush()
+  if writeErr == nil {
+    writeErr = tempRegistry.Close()
+  } else {
+    tempRegistry.Close()
+  }
+
+  if writeErr == nil {
+    writeErr = os.Rename(tempRegistry.Name(), registryFilename)
+  }
+
+  if writeErr != nil {
+    os.Remove(tempRegistry.Name())
+    return errors.New(s("Failed to write tag registry file\n %s\n", writeErr.Error()))
+  }
+
+  return nil
+}
+
+func mapCategories(rawCategories []string) ([]string, sql.NullInt64) {
+  // providers put several categories into one element ("Комедия, боевик"),
+  // each of them is mapped separately, duplicates are dropped
+
+  var contentNibble sql.NullInt64
+
+  categories := make([]string, 0, len(rawCategories))
+  seen := make(map[string]struct{})
+
+  for _, rawCategory := range rawCategories {
+    for _, category := range strings.Split(rawCategory, ",") {
+      category = strings.TrimSpace(category)
+
+      if category == "" {
+        continue
+      }
+
+      if categoryMap != nil {
+        if genreMeta, ok := categoryMap[strings.ToLower(category)]; ok {
+          category = genreMeta.Genre
+
+          if !contentNibble.Valid && genreMeta.ContentNibble != 0 {
+            contentNibble = nullableInt(genreMeta.ContentNibble)
+          }
+        } else {
+          unmappedCategories[category] += 1
+        }
+      }
+
+      if _, dupe := seen[category]; dupe {
+        continue
+      }
+
+      seen[category] = struct{}{}
+
+      categories = append(categories, category)
+    }
+  }
+
+  return categories, contentNibble
 }
 
 func processXspf(ctx *RequestContext, xspfFilename string) {
@@ -556,7 +1257,14 @@ root:
     Bail("Could not start transaction\n %s\n", txErr.Error())
   }
 
-  var track *Track
+  updateSql3, err := bulkTx.Prepare("UPDATE channel_aliases SET ch_id = ? WHERE ch_id = ?;")
+  if err != nil {
+    Bail("Failed to compile UPDATE\n %s\n", err.Error())
+  }
+
+  defer updateSql3.Close()
+
+  var track *Track
 
   // iterate over all <track> tags and add them to database
   for {
@@ -569,9 +1277,9 @@ root:
       }
     }
 
-    qSql, _ := bulkTx.Prepare("SELECT ch_id FROM channels WHERE name = ?;")
+    qSql, _ := bulkTx.Prepare("SELECT ch_id FROM channels WHERE name = ?1 UNION ALL SELECT ch_id FROM channel_aliases WHERE name = ?1 LIMIT 1;")
 
-    updateSql, err := bulkTx.Prepare("UPDATE channels SET archive_time = ?, ch_page = ?, image_uri = ?, ch_id = ? WHERE ch_id = ?;")
+    updateSql, err := bulkTx.Prepare("UPDATE channels SET archive_time = ?, ch_page = ?, image_uri = ?, ch_number = COALESCE(?, ch_number), ch_id = ? WHERE ch_id = ?;")
     if err != nil {
       Bail("Failed to compile UPDATE\n %s\n", err.Error())
     }
@@ -597,7 +1305,7 @@ root:
             Bail("Failed to process <track>\n %s\n", decErr.Error())
           }
 
-          added, err := addTrack(ctx, track, qSql, updateSql, updateSql2, bulkTx)
+          added, err := addTrack(ctx, track, qSql, updateSql, updateSql2, updateSql3, bulkTx)
           if err != nil {
             Bail("Failed to process <track>\n %s\n", err.Error())
           }
@@ -631,7 +1339,7 @@ root:
   fmt.Printf("%d out of %d XSPF tracks had useful metadata \n", lineNum, tracksTotal)
 }
 
-func addTrack(ctx *RequestContext, track *Track, q *sql.Stmt, updSql *sql.Stmt, updSql2 *sql.Stmt, bulkTx *sql.Tx) (bool, error) {
+func addTrack(ctx *RequestContext, track *Track, q *sql.Stmt, updSql *sql.Stmt, updSql2 *sql.Stmt, updSql3 *sql.Stmt, bulkTx *sql.Tx) (bool, error) {
   if track.PsFile == "" {
     //fmt.Fprintf(os.Stderr, "No <psfile>\n")
     return false, nil
@@ -663,17 +1371,22 @@ func addTrack(ctx *RequestContext, track *Track, q *sql.Stmt, updSql *sql.Stmt,
   if scanErr == sql.ErrNoRows {
     // insert completely new entry for channel (so we can search EPG for it's name)
 
-    _, insertErr := bulkTx.Stmt(ctx.sql5).Exec(track.PsFile, chImgUri, processedTitle, track.ArchiveLimit, chPageUri)
+    _, insertErr := bulkTx.Stmt(ctx.sql5).Exec(track.PsFile, chImgUri, processedTitle, track.ArchiveLimit, chPageUri, nullableInt(track.Number), nil)
     if insertErr != nil {
       return false, insertErr
     }
 
+    aliasErr := addChannelAlias(ctx, bulkTx, track.PsFile, track.Title, "")
+    if aliasErr != nil {
+      return false, aliasErr
+    }
+
     return true, nil
   } else if scanErr != nil {
     return false, scanErr
   }
 
-  _, updateErr := updSql.Exec(track.ArchiveLimit, chPageUri, chImgUri, track.PsFile, foundChId)
+  _, updateErr := updSql.Exec(track.ArchiveLimit, chPageUri, chImgUri, nullableInt(track.Number), track.PsFile, foundChId)
   if updateErr != nil {
     fmt.Fprintf(os.Stderr, "Failed to update channels table for '%s' (ch_id = '%s'): new ch_id is '%s'\n", track.Title, foundChId, track.PsFile)
 
@@ -689,6 +1402,22 @@ func addTrack(ctx *RequestContext, track *Track, q *sql.Stmt, updSql *sql.Stmt,
     return false, updateErr2
   }
 
+  _, updateErr3 := updSql3.Exec(track.PsFile, foundChId)
+  if updateErr3 != nil {
+    fmt.Fprintf(os.Stderr, "Failed to update channel_aliases table for '%s' (ch_id = '%s'): new ch_id is '%s'\n", track.Title, foundChId, track.PsFile)
+
+    return false, updateErr3
+  }
+
+  // keep aliases of renamed channel deduplicated against new ch_id
+  for aliasKey := range ctx.aliasMap {
+    if strings.HasPrefix(aliasKey, foundChId + "|") {
+      delete(ctx.aliasMap, aliasKey)
+
+      ctx.aliasMap[track.PsFile + strings.TrimPrefix(aliasKey, foundChId)] = struct{}{}
+    }
+  }
+
   return true, nil
 }
 
@@ -722,6 +1451,26 @@ func addOptionalCols() string {
   return b.String()
 }
 
+func addExtraCols() string {
+  var b strings.Builder
+
+  for _, col := range extraMetaCols {
+    b.WriteString(s(", %s %s", col.Name, col.Type))
+  }
+
+  return b.String()
+}
+
+func copyExtraCols() string {
+  var b strings.Builder
+
+  for _, col := range extraMetaCols {
+    b.WriteString(s(", %s", col.Name))
+  }
+
+  return b.String()
+}
+
 func initDb(ctx *RequestContext, dbNam string) error {
   db := ctx.db
 
@@ -737,7 +1486,7 @@ func initDb(ctx *RequestContext, dbNam string) error {
   if err != nil {
     return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
   }
-  _, err = db.Exec(s("CREATE TABLE %s.channels (_id INTEGER PRIMARY KEY, image_uri TEXT, ch_id NOT NULL UNIQUE, name TEXT, archive_time INTEGER NOT NULL, ch_page TEXT);", dbNam))
+  _, err = db.Exec(s("CREATE TABLE %s.channels (_id INTEGER PRIMARY KEY, image_uri TEXT, ch_id NOT NULL UNIQUE, name TEXT, archive_time INTEGER NOT NULL, ch_page TEXT, ch_number INTEGER, homepage TEXT);", dbNam))
   if err != nil {
     return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
   }
@@ -753,7 +1502,23 @@ func initDb(ctx *RequestContext, dbNam string) error {
   if err != nil {
     return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
   }
-  _, err = db.Exec(s("CREATE TABLE %s.search_meta_0 (_id INTEGER PRIMARY KEY, ch_id NOT NULL, start_time INTEGER NOT NULL, title_id INTEGER NOT NULL, description_id INTEGER NOT NULL, tags INTEGER NOT NULL, year INTEGER, image_uri INTEGER);", dbNam))
+
+  // all display names of channels, docid of fts_channels is _id of channel_aliases
+  _, err = db.Exec(s("CREATE TABLE %s.channel_aliases (_id INTEGER PRIMARY KEY, ch_id NOT NULL, name TEXT NOT NULL, lang TEXT)", dbNam))
+  if err != nil {
+    return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
+  }
+
+  if useLegacyFormat {
+    _, err = db.Exec(s("CREATE VIRTUAL TABLE %s.fts_channels USING fts4(content='', matchinfo='fts3', prefix='3', text, tokenize=simple);", dbNam))
+  } else {
+    _, err = db.Exec(s("CREATE VIRTUAL TABLE %s.fts_channels USING fts4(content='', matchinfo='fts3', prefix='3', text, tokenize=unicode61);", dbNam))
+  }
+
+  if err != nil {
+    return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
+  }
+  _, err = db.Exec(s("CREATE TABLE %s.search_meta_0 (_id INTEGER PRIMARY KEY, ch_id NOT NULL, start_time INTEGER NOT NULL, title_id INTEGER NOT NULL, description_id INTEGER NOT NULL, tags INTEGER NOT NULL, year INTEGER, image_uri INTEGER%s);", dbNam, addExtraCols()))
   if err != nil {
     return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
   }
@@ -769,12 +1534,61 @@ func initDb(ctx *RequestContext, dbNam string) error {
   if err != nil {
     return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
   }
+  _, err = db.Exec(s("CREATE TABLE %s.programme_flags (_id INTEGER PRIMARY KEY, flag TEXT NOT NULL)", dbNam))
+  if err != nil {
+    return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
+  }
+
+  for _, flagName := range flagNames {
+    _, err = db.Exec(s("INSERT INTO %s.programme_flags (_id, flag) VALUES (?, ?)", dbNam), flagName.IdVal, flagName.Name)
+    if err != nil {
+      return errors.New(s("INSERT failed\n %s\n", err.Error()))
+    }
+  }
+
   _, err = db.Exec(s("CREATE TABLE %s.eltex_temp_search_tags (_id INTEGER PRIMARY KEY, tag_list TEXT)", dbNam))
   if err != nil {
     return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
   }
+  _, err = db.Exec(s("CREATE TABLE %s.eltex_temp_enrich (ch_id NOT NULL, start_time INTEGER NOT NULL, rank INTEGER NOT NULL, title TEXT NOT NULL, description TEXT, image TEXT, year INTEGER)", dbNam))
+  if err != nil {
+    return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
+  }
+  _, err = db.Exec(s("CREATE TABLE %s.programme_urls (programme_id INTEGER NOT NULL, uri_id INTEGER NOT NULL, system TEXT)", dbNam))
+  if err != nil {
+    return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
+  }
+  _, err = db.Exec(s("CREATE UNIQUE INDEX %s.unique_programme_url ON programme_urls (programme_id, uri_id);", dbNam))
+  if err != nil {
+    return errors.New(s("index creation failed\n %s\n", err.Error()))
+  }
+  _, err = db.Exec(s("CREATE TABLE %s.programme_images (programme_id INTEGER NOT NULL, uri_id INTEGER NOT NULL, type TEXT, orient TEXT, size INTEGER, width INTEGER, height INTEGER)", dbNam))
+  if err != nil {
+    return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
+  }
+  _, err = db.Exec(s("CREATE TABLE %s.programme_keywords (programme_id INTEGER NOT NULL, keyword_id INTEGER NOT NULL)", dbNam))
+  if err != nil {
+    return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
+  }
+  // providers repeat the same <keyword> within a programme
+  _, err = db.Exec(s("CREATE UNIQUE INDEX %s.unique_programme_keyword ON programme_keywords (programme_id, keyword_id);", dbNam))
+  if err != nil {
+    return errors.New(s("index creation failed\n %s\n", err.Error()))
+  }
+
+  if storeTranslations {
+    _, err = db.Exec(s("CREATE TABLE %s.translations (programme_id INTEGER NOT NULL, lang TEXT NOT NULL, title_id INTEGER, sub_title_id INTEGER, description_id INTEGER)", dbNam))
+    if err != nil {
+      return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
+    }
+  }
+  // names of cast and crew are stored in text table, so they can be found by fts_search
+  _, err = db.Exec(s("CREATE TABLE %s.credits (programme_id INTEGER NOT NULL, person_id INTEGER NOT NULL, credit_type TEXT NOT NULL, role TEXT)", dbNam))
+  if err != nil {
+    return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
+  }
 
-  ctx.sql1, err = db.Prepare("INSERT INTO search_meta_0 (start_time, ch_id, image_uri, title_id, description_id, year, tags) VALUES (?, ?, ?, ?, ?, ?, ?);")
+  ctx.sql1, err = db.Prepare("INSERT INTO search_meta_0 (start_time, ch_id, image_uri, title_id, description_id, year, tags, season, season_total, episode, episode_total, part, part_total, age_rating, adult, end_time, flags, video_quality, aspect_ratio, colour, audio, subtitles, country, language, orig_language, length, content_nibble, title_lang) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);")
   if err != nil {
     return errors.New(s("Prepare() failed: %s\n", err.Error()))
   }
@@ -790,7 +1604,7 @@ func initDb(ctx *RequestContext, dbNam string) error {
   if err != nil {
     return errors.New(s("Prepare() failed: %s\n", err.Error()))
   }
-  ctx.sql5, err = db.Prepare("INSERT OR IGNORE INTO channels (ch_id, image_uri, name, archive_time, ch_page) VALUES (?, ?, ?, ?, ?);")
+  ctx.sql5, err = db.Prepare("INSERT OR IGNORE INTO channels (ch_id, image_uri, name, archive_time, ch_page, ch_number, homepage) VALUES (?, ?, ?, ?, ?, ?, ?);")
   if err != nil {
     return errors.New(s("Prepare() failed: %s\n", err.Error()))
   }
@@ -802,10 +1616,355 @@ func initDb(ctx *RequestContext, dbNam string) error {
   if err != nil {
     return errors.New(s("Prepare() failed: %s\n", err.Error()))
   }
+  ctx.sql8, err = db.Prepare("INSERT INTO credits (programme_id, person_id, credit_type, role) VALUES (?, ?, ?, ?);")
+  if err != nil {
+    return errors.New(s("Prepare() failed: %s\n", err.Error()))
+  }
+  ctx.sql10, err = db.Prepare("INSERT INTO channel_aliases (ch_id, name, lang) VALUES (?, ?, ?);")
+  if err != nil {
+    return errors.New(s("Prepare() failed: %s\n", err.Error()))
+  }
+  ctx.sql11, err = db.Prepare("INSERT INTO fts_channels (docid, text) VALUES (?, ?);")
+  if err != nil {
+    return errors.New(s("Prepare() failed: %s\n", err.Error()))
+  }
+  ctx.sql12, err = db.Prepare("INSERT OR IGNORE INTO programme_urls (programme_id, uri_id, system) VALUES (?, ?, ?);")
+  if err != nil {
+    return errors.New(s("Prepare() failed: %s\n", err.Error()))
+  }
+  ctx.sql13, err = db.Prepare("INSERT OR IGNORE INTO programme_keywords (programme_id, keyword_id) VALUES (?, ?);")
+  if err != nil {
+    return errors.New(s("Prepare() failed: %s\n", err.Error()))
+  }
+  ctx.sql14, err = db.Prepare("INSERT INTO programme_images (programme_id, uri_id, type, orient, size, width, height) VALUES (?, ?, ?, ?, ?, ?, ?);")
+  if err != nil {
+    return errors.New(s("Prepare() failed: %s\n", err.Error()))
+  }
+  ctx.sql17, err = db.Prepare("INSERT INTO eltex_temp_enrich (ch_id, start_time, rank, title, description, image, year) VALUES (?, ?, ?, ?, ?, ?, ?);")
+  if err != nil {
+    return errors.New(s("Prepare() failed: %s\n", err.Error()))
+  }
+  ctx.sql15, err = db.Prepare("SELECT _id, end_time, description_id FROM search_meta_0 WHERE ch_id = ? AND start_time = ?;")
+  if err != nil {
+    return errors.New(s("Prepare() failed: %s\n", err.Error()))
+  }
+  ctx.sql16, err = db.Prepare("UPDATE search_meta_0 SET description_id = CASE WHEN description_id = ? THEN ? ELSE description_id END, image_uri = COALESCE(image_uri, ?), year = COALESCE(year, ?), season = COALESCE(season, ?), season_total = COALESCE(season_total, ?), episode = COALESCE(episode, ?), episode_total = COALESCE(episode_total, ?), part = COALESCE(part, ?), part_total = COALESCE(part_total, ?), age_rating = COALESCE(age_rating, ?), adult = MAX(adult, ?), end_time = COALESCE(end_time, ?), flags = flags | ?, video_quality = COALESCE(video_quality, ?), aspect_ratio = COALESCE(aspect_ratio, ?), colour = COALESCE(colour, ?), audio = COALESCE(audio, ?), subtitles = subtitles | ?, country = COALESCE(country, ?), language = COALESCE(language, ?), orig_language = COALESCE(orig_language, ?), length = COALESCE(length, ?), content_nibble = COALESCE(content_nibble, ?) WHERE _id = ?;")
+  if err != nil {
+    return errors.New(s("Prepare() failed: %s\n", err.Error()))
+  }
+  if storeTranslations {
+    ctx.sql9, err = db.Prepare("INSERT INTO translations (programme_id, lang, title_id, sub_title_id, description_id) VALUES (?, ?, ?, ?, ?);")
+    if err != nil {
+      return errors.New(s("Prepare() failed: %s\n", err.Error()))
+    }
+  }
 
   return nil
 }
 
+func isHttpSource(path string) bool {
+  lowerPath := strings.ToLower(path)
+
+  return strings.HasPrefix(lowerPath, "http://") || strings.HasPrefix(lowerPath, "https://")
+}
+
+func isOlderThan(path string, outPath string) bool {
+  // optional files, that weren't specified, are never considered as changed
+  if path == "" {
+    return true
+  }
+
+  srcInfo, srcErr := os.Stat(path)
+  if srcErr != nil {
+    return false
+  }
+
+  outInfo, outErr := os.Stat(outPath)
+  if outErr != nil {
+    return false
+  }
+
+  return srcInfo.ModTime().Before(outInfo.ModTime())
+}
+
+func readHttpCacheMeta(metaPath string) (etag string, lastModified string) {
+  metaFile, metaErr := os.Open(metaPath)
+  if metaErr != nil {
+    return "", ""
+  }
+
+  defer metaFile.Close()
+
+  metaScanner := bufio.NewScanner(metaFile)
+
+  for metaScanner.Scan() {
+    sepIdx := strings.SplitN(metaScanner.Text(), "|", 2)
+
+    if len(sepIdx) < 2 {
+      continue
+    }
+
+    switch sepIdx[0] {
+      case "etag":
+        etag = sepIdx[1]
+      case "last-modified":
+        lastModified = sepIdx[1]
+    }
+  }
+
+  return etag, lastModified
+}
+
+func fetchXmltv(sourceUrl string) (string, error) {
+  // downloads XMLTV file to local disk and returns path to it;
+  // if cache directory is configured, the file is revalidated with conditional GET
+  // and the cached copy is reused, when the server responds with 304
+
+  var bodyPath, metaPath string
+
+  tmpDir := httpCacheDir
+
+  if httpCacheDir != "" {
+    mkdirErr := os.MkdirAll(httpCacheDir, 0755)
+    if mkdirErr != nil {
+      return "", errors.New(s("Failed to create cache directory\n %s\n", mkdirErr.Error()))
+    }
+
+    urlHash := sha1.Sum([]byte(sourceUrl))
+    cacheName := hex.EncodeToString(urlHash[:])
+
+    bodyPath = filepath.Join(httpCacheDir, cacheName + ".xmltv")
+    metaPath = filepath.Join(httpCacheDir, cacheName + ".meta")
+  }
+
+  etag, lastModified := "", ""
+
+  if bodyPath != "" {
+    if _, statErr := os.Stat(bodyPath); statErr == nil {
+      etag, lastModified = readHttpCacheMeta(metaPath)
+    }
+  }
+
+  client := &http.Client{
+    Timeout: httpTimeout,
+  }
+
+  var lastErr error
+
+  for attempt := 0; attempt <= httpRetries; attempt++ {
+    if attempt != 0 {
+      fmt.Fprintf(os.Stderr, "Download of %s failed, retrying (%d of %d)\n %s", sourceUrl, attempt, httpRetries, lastErr.Error())
+
+      time.Sleep(time.Duration(attempt) * httpRetryDelay)
+    }
+
+    fmt.Printf("Downloading %s\n", sourceUrl)
+
+    req, reqErr := http.NewRequest("GET", sourceUrl, nil)
+    if reqErr != nil {
+      return "", errors.New(s("Invalid URL %s\n %s\n", sourceUrl, reqErr.Error()))
+    }
+
+    req.Header.Set("User-Agent", "eltex-epg-parser/" + EltexPackageVersion)
+
+    if etag != "" {
+      req.Header.Set("If-None-Match", etag)
+    }
+
+    if lastModified != "" {
+      req.Header.Set("If-Modified-Since", lastModified)
+    }
+
+    resp, respErr := client.Do(req)
+    if respErr != nil {
+      lastErr = errors.New(s("%s\n", respErr.Error()))
+      continue
+    }
+
+    if resp.StatusCode == http.StatusNotModified && bodyPath != "" && (etag != "" || lastModified != "") {
+      resp.Body.Close()
+
+      fmt.Printf("%s is not modified, using cached copy\n", sourceUrl)
+
+      return bodyPath, nil
+    }
+
+    if resp.StatusCode != http.StatusOK {
+      resp.Body.Close()
+
+      lastErr = errors.New(s("Server responded with %s\n", resp.Status))
+
+      if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+        continue
+      }
+
+      return "", errors.New(s("Failed to download %s\n %s", sourceUrl, lastErr.Error()))
+    }
+
+    tmpFile, tmpErr := ioutil.TempFile(tmpDir, "xmltv-*.tmp")
+    if tmpErr != nil {
+      resp.Body.Close()
+
+      return "", errors.New(s("Cannot create temporary file\n %s\n", tmpErr.Error()))
+    }
+
+    _, copyErr := io.Copy(tmpFile, resp.Body)
+
+    resp.Body.Close()
+    tmpFile.Close()
+
+    if copyErr != nil {
+      os.Remove(tmpFile.Name())
+
+      lastErr = errors.New(s("%s\n", copyErr.Error()))
+      continue
+    }
+
+    if bodyPath == "" {
+      tempSources = append(tempSources, tmpFile.Name())
+
+      return tmpFile.Name(), nil
+    }
+
+    renameErr := os.Rename(tmpFile.Name(), bodyPath)
+    if renameErr != nil {
+      os.Remove(tmpFile.Name())
+
+      return "", errors.New(s("Failed to move downloaded file to cache\n %s\n", renameErr.Error()))
+    }
+
+    var metaBuilder strings.Builder
+
+    metaBuilder.WriteString(s("url|%s\n", sourceUrl))
+    metaBuilder.WriteString(s("etag|%s\n", resp.Header.Get("ETag")))
+    metaBuilder.WriteString(s("last-modified|%s\n", resp.Header.Get("Last-Modified")))
+
+    metaErr := ioutil.WriteFile(metaPath, []byte(metaBuilder.String()), 0644)
+    if metaErr != nil {
+      fmt.Fprintf(os.Stderr, "Failed to write cache metadata for %s\n %s\n", sourceUrl, metaErr.Error())
+    }
+
+    return bodyPath, nil
+  }
+
+  return "", errors.New(s("Failed to download %s after %d attempts\n %s", sourceUrl, httpRetries + 1, lastErr.Error()))
+}
+
+func openXmltv(path string) (io.Reader, error) {
+  xmlFile, openErr := os.Open(path)
+  if openErr != nil {
+    return nil, openErr
+  }
+
+  return decompressXmltv(path, xmlFile)
+}
+
+func decompressXmltv(name string, source io.Reader) (io.Reader, error) {
+  // providers ship XMLTV in all sorts of containers, and file extensions
+  // are not reliable (especially for stdin), so we look at magic bytes instead
+
+  buffered := bufio.NewReaderSize(source, 1024 * 128)
+
+  magic, _ := buffered.Peek(6)
+
+  switch {
+    case bytes.HasPrefix(magic, []byte{ 0x1f, 0x8b }):
+      fmt.Printf("Detected gzip compression in %s\n", name)
+
+      gzipReader, gzErr := gzip.NewReader(buffered)
+      if gzErr != nil {
+        return nil, errors.New(s("Failed to open gzip stream\n %s\n", gzErr.Error()))
+      }
+
+      return bufio.NewReaderSize(gzipReader, 1024 * 128), nil
+    case bytes.HasPrefix(magic, []byte{ 0xfd, '7', 'z', 'X', 'Z', 0x00 }):
+      fmt.Printf("Detected xz compression in %s\n", name)
+
+      xzReader, xzErr := xz.NewReader(buffered)
+      if xzErr != nil {
+        return nil, errors.New(s("Failed to open xz stream\n %s\n", xzErr.Error()))
+      }
+
+      return bufio.NewReaderSize(xzReader, 1024 * 128), nil
+    case bytes.HasPrefix(magic, []byte("BZh")):
+      fmt.Printf("Detected bzip2 compression in %s\n", name)
+
+      return bufio.NewReaderSize(bzip2.NewReader(buffered), 1024 * 128), nil
+    case bytes.HasPrefix(magic, []byte{ 0x28, 0xb5, 0x2f, 0xfd }):
+      fmt.Printf("Detected zstd compression in %s\n", name)
+
+      zstdReader, zstdErr := zstd.NewReader(buffered)
+      if zstdErr != nil {
+        return nil, errors.New(s("Failed to open zstd stream\n %s\n", zstdErr.Error()))
+      }
+
+      return bufio.NewReaderSize(zstdReader, 1024 * 128), nil
+    case bytes.HasPrefix(magic, []byte{ 'P', 'K', 0x03, 0x04 }):
+      fmt.Printf("Detected zip archive in %s\n", name)
+
+      return unpackXmltvZip(name, source, buffered)
+  }
+
+  return buffered, nil
+}
+
+func unpackXmltvZip(name string, source io.Reader, buffered *bufio.Reader) (io.Reader, error) {
+  // zip central directory is located at the end of archive, so we need random access;
+  // regular files already have it, everything else (pipes) is read into memory
+
+  var archive *zip.Reader
+  var zipErr error
+
+  if sourceFile, isFile := source.(*os.File); isFile {
+    fileInfo, statErr := sourceFile.Stat()
+
+    if statErr == nil && fileInfo.Mode().IsRegular() {
+      archive, zipErr = zip.NewReader(sourceFile, fileInfo.Size())
+    }
+  }
+
+  if archive == nil && zipErr == nil {
+    zipBytes, readErr := ioutil.ReadAll(buffered)
+    if readErr != nil {
+      return nil, errors.New(s("Failed to read zip archive\n %s\n", readErr.Error()))
+    }
+
+    archive, zipErr = zip.NewReader(bytes.NewReader(zipBytes), int64(len(zipBytes)))
+  }
+
+  if zipErr != nil {
+    return nil, errors.New(s("Failed to open zip archive\n %s\n", zipErr.Error()))
+  }
+
+  var entry *zip.File
+
+  for _, zipEntry := range archive.File {
+    if zipEntry.FileInfo().IsDir() {
+      continue
+    }
+
+    if entry != nil {
+      return nil, errors.New(s("Zip archive %s contains more than one file (%s, %s)\n", name, entry.Name, zipEntry.Name))
+    }
+
+    entry = zipEntry
+  }
+
+  if entry == nil {
+    return nil, errors.New(s("Zip archive %s is empty\n", name))
+  }
+
+  fmt.Printf("Extracting %s from %s\n", entry.Name, name)
+
+  entryReader, entryErr := entry.Open()
+  if entryErr != nil {
+    return nil, errors.New(s("Failed to extract %s from zip archive\n %s\n", entry.Name, entryErr.Error()))
+  }
+
+  // the archive might contain another compressed file (e.g. xmltv.xml.gz inside zip)
+  return decompressXmltv(entry.Name, entryReader)
+}
+
 func processXml(ctx *RequestContext, dbNam string, xmlFile io.Reader) error {
   db := ctx.db
 
@@ -817,6 +1976,9 @@ func processXml(ctx *RequestContext, dbNam string, xmlFile io.Reader) error {
   decoder := xml.NewDecoder(xmlFile)
   decoder.CharsetReader = charset.NewReaderLabel
 
+  // order of programmes is tracked separately in each file
+  ctx.lastStarts = make(map[string]int64)
+
   // skip root
 root:
   for {
@@ -891,19 +2053,6 @@ root:
     }
   }
 
-  // determine new EPG bounds after processing this XMLTV file
-
-  var chEndTime, chStartTime int64
-
-  for chI, chEnd := range ctx.endMap {
-    chEndTime = chEnd.StartTime
-    chStartTime = ctx.bgnMap[chI].StartTime
-
-    newLimits := [2]int64{ chStartTime, chEndTime }
-
-    ctx.limits[chI] = newLimits
-  }
-
   bulkTxError := bulkTx.Commit()
   if bulkTxError != nil {
     return errors.New(s("Failed to commit primary transaction\n %s\n", bulkTxError.Error()))
@@ -912,690 +2061,3145 @@ root:
   return nil
 }
 
-func finishDb(ctx *RequestContext, dbNam string) error {
-  if (ctx.appendedElements == 0) {
-    emptyErrStr := fmt.Sprintf("no elements within specified period (%s)", startFrom.Format(eltDateFormat))
+func parseSourceList(value string) ([]int, error) {
+  sources := make([]int, 0)
+  seen := make(map[int]bool)
 
-    if (dbLastDate != nil) {
-      emptyErrStr += fmt.Sprintf(", last slot is at %s", (*dbLastDate).Format(eltDateFormat))
+  for _, item := range strings.Split(value, ",") {
+    item = strings.TrimSpace(item)
+
+    source, err := strconv.Atoi(item)
+    if err != nil || source <= 0 {
+      return nil, errors.New(s("'%s' is not a number of input file", item))
     }
 
-    if (dbEarliestDate != nil) {
-      emptyErrStr += fmt.Sprintf(", first slot is at %s", (*dbEarliestDate).Format(eltDateFormat))
+    if seen[source] {
+      return nil, errors.New(s("input file %d is listed more than once", source))
     }
 
-    return errors.New(s("%s\n", emptyErrStr))
+    seen[source] = true
+    sources = append(sources, source)
   }
 
-  var err error
-
-  db := ctx.db
+  return sources, nil
+}
+
+func checkSourceLists() {
+  // numbers of input files are known only after -input is split
+  for _, source := range sourcePriority {
+    if source > len(sourceNames) {
+      Bail("Bad -source-priority value: input file %d does not exist, there are %d of them\n", source, len(sourceNames))
+    }
+  }
+
+  for chId, priority := range channelPriorities {
+    for _, source := range priority {
+      if source > len(sourceNames) {
+        Bail("Bad source priority of channel %s in map file: input file %d does not exist, there are %d of them\n", chId, source, len(sourceNames))
+      }
+    }
+  }
+}
+
+func sourceOrder(chId string) []int {
+  // numbers in priority lists start with 1, same as in reports
+  priority, ok := channelPriorities[chId]
+  if !ok {
+    priority = sourcePriority
+  }
+
+  order := make([]int, 0, len(sourceNames))
+  seen := make(map[int]bool)
+
+  for _, source := range priority {
+    if source <= len(sourceNames) && !seen[source - 1] {
+      seen[source - 1] = true
+      order = append(order, source - 1)
+    }
+  }
+
+  // files without explicit priority are trusted less, in order of -input
+  for source := range sourceNames {
+    if !seen[source] {
+      order = append(order, source)
+    }
+  }
+
+  return order
+}
+
+func scanSource(path string, source int, scanned map[string][]ScannedSlot) error {
+  rawFile, openErr := os.Open(path)
+  if openErr != nil {
+    return errors.New(s("Could not open XMLTV file\n %s\n", openErr.Error()))
+  }
+
+  defer rawFile.Close()
+
+  xmlFile, openErr := decompressXmltv(path, rawFile)
+  if openErr != nil {
+    return errors.New(s("Could not open XMLTV file\n %s\n", openErr.Error()))
+  }
+
+  fmt.Printf("Scanning %s\n", path)
+
+  decoder := xml.NewDecoder(xmlFile)
+  decoder.CharsetReader = charset.NewReaderLabel
+
+  lastStarts := make(map[string]int64)
+
+  for {
+    t, tokenErr := decoder.Token()
+    if tokenErr != nil {
+      if tokenErr == io.EOF {
+        break
+      } else {
+        return errors.New(s("Failed to read token\n %s\n", tokenErr.Error()))
+      }
+    }
+
+    startElement, ok := t.(xml.StartElement)
+    if !ok || startElement.Name.Local != "programme" {
+      continue
+    }
+
+    slot := ProgrammeSlot{}
+
+    decErr := decoder.DecodeElement(&slot, &startElement)
+    if decErr != nil {
+      return errors.New(s("Could not decode element\n %s\n", decErr.Error()))
+    }
+
+    chId, startTime, endTime, slotFlags := programmeSlot(slot.Channel, slot.Start, slot.End, lastStarts)
+    if slotFlags & SlotSkipped != 0 {
+      // bad dates are reported, when the file is read for real
+      continue
+    }
+
+    hasImage := false
+
+    for _, icon := range slot.Images {
+      hasImage = hasImage || icon.Uri != ""
+    }
+
+    for _, image := range slot.ExtraImages {
+      hasImage = hasImage || strings.TrimSpace(image.Uri) != ""
+    }
+
+    scanned[chId] = append(scanned[chId], ScannedSlot{
+      Source: source,
+      StartTime: startTime.Unix(),
+      EndTime: endTime,
+      HasDescription: langText(slot.Descriptions, pickLang(slot.Descriptions)) != "",
+      HasImage: hasImage,
+    })
+  }
+
+  return nil
+}
+
+func resolveSources(scanned map[string][]ScannedSlot) {
+  acceptedSlots = make(map[SourceSlot]struct{})
+  sourceSpans = make(map[string][]SourceSpan)
+  sourceScores = make(map[string][]SourceScore)
+  channelOrders = make(map[string][]int)
+
+  for chId, slots := range scanned {
+    sort.SliceStable(slots, func(i, j int) bool {
+      return slots[i].StartTime < slots[j].StartTime
+    })
+
+    order := sourceOrder(chId)
+
+    if _, fixed := channelPriorities[chId]; sourceAuto && !fixed {
+      order = scoreSources(chId, slots)
+    }
+
+    channelOrders[chId] = order
+
+    // time already covered by more trusted files, sorted by start
+    coverage := make([][2]int64, 0)
+    accepted := make([]SourceSpan, 0)
+
+    for _, source := range order {
+      sourceSlots := slotsOfSource(slots, source)
+      sourceEnds := slotEnds(sourceSlots)
+
+      sourceAccepted := make([]SourceSpan, 0, len(sourceSlots))
+
+      for i, slot := range sourceSlots {
+        endTime := sourceEnds[i]
+
+        covered := sort.Search(len(coverage), func(n int) bool {
+          return coverage[n][1] > slot.StartTime
+        })
+
+        if covered < len(coverage) && coverage[covered][0] < endTime {
+          continue
+        }
+
+        acceptedSlots[SourceSlot{ chId, source, slot.StartTime }] = struct{}{}
+
+        sourceAccepted = append(sourceAccepted, SourceSpan{ source, slot.StartTime, endTime })
+      }
+
+      for _, span := range sourceAccepted {
+        coverage = append(coverage, [2]int64{ span.StartTime, span.EndTime })
+      }
+
+      sort.Slice(coverage, func(i, j int) bool {
+        return coverage[i][0] < coverage[j][0]
+      })
+
+      // programmes of one file may overlap, merge them to keep ends sorted as well
+      merged := make([][2]int64, 0, len(coverage))
+
+      for _, interval := range coverage {
+        if len(merged) != 0 && merged[len(merged) - 1][1] >= interval[0] {
+          if interval[1] > merged[len(merged) - 1][1] {
+            merged[len(merged) - 1][1] = interval[1]
+          }
+          continue
+        }
+
+        merged = append(merged, interval)
+      }
+
+      coverage = merged
+
+      accepted = append(accepted, sourceAccepted...)
+    }
+
+    sort.Slice(accepted, func(i, j int) bool {
+      return accepted[i].StartTime < accepted[j].StartTime
+    })
+
+    // adjacent programmes from the same file are reported as a single span
+    spans := make([]SourceSpan, 0)
+
+    for _, span := range accepted {
+      if len(spans) != 0 && spans[len(spans) - 1].Source == span.Source {
+        if span.EndTime > spans[len(spans) - 1].EndTime {
+          spans[len(spans) - 1].EndTime = span.EndTime
+        }
+        continue
+      }
+
+      spans = append(spans, span)
+    }
+
+    sourceSpans[chId] = spans
+  }
+}
+
+func slotsOfSource(slots []ScannedSlot, source int) []ScannedSlot {
+  sourceSlots := make([]ScannedSlot, 0)
+
+  for _, slot := range slots {
+    if slot.Source == source {
+      sourceSlots = append(sourceSlots, slot)
+    }
+  }
+
+  return sourceSlots
+}
+
+func slotEnds(sourceSlots []ScannedSlot) []int64 {
+  ends := make([]int64, len(sourceSlots))
+
+  for i, slot := range sourceSlots {
+    // same as in finishDb, programme without stop time lasts until the next one
+    ends[i] = slot.StartTime + 1
+
+    if slot.EndTime.Valid {
+      ends[i] = slot.EndTime.Int64
+    } else if i + 1 < len(sourceSlots) && sourceSlots[i + 1].StartTime > slot.StartTime {
+      ends[i] = sourceSlots[i + 1].StartTime
+    }
+  }
+
+  return ends
+}
+
+func scoreSources(chId string, slots []ScannedSlot) []int {
+  // score is number of days, covered by file, weighted by share of programmes with
+  // descriptions and images and reduced by share of overlaps and gaps between programmes
+  scores := make([]SourceScore, 0, len(sourceNames))
+
+  for source := range sourceNames {
+    sourceSlots := slotsOfSource(slots, source)
+    sourceEnds := slotEnds(sourceSlots)
+
+    score := SourceScore{
+      Source: source,
+    }
+
+    if len(sourceSlots) != 0 {
+      var covered, lastEnd int64
+      var descriptions, images int
+
+      for i, slot := range sourceSlots {
+        // programme should start exactly when the previous one ends
+        if i != 0 && slot.StartTime != lastEnd {
+          score.Problems += 1
+        }
+
+        if slot.StartTime >= lastEnd {
+          covered += sourceEnds[i] - slot.StartTime
+        } else if sourceEnds[i] > lastEnd {
+          covered += sourceEnds[i] - lastEnd
+        }
+
+        if sourceEnds[i] > lastEnd {
+          lastEnd = sourceEnds[i]
+        }
+
+        if slot.HasDescription {
+          descriptions += 1
+        }
+
+        if slot.HasImage {
+          images += 1
+        }
+      }
+
+      total := float64(len(sourceSlots))
+
+      score.Days = float64(covered) / 86400
+      score.DescriptionShare = float64(descriptions) / total
+      score.ImageShare = float64(images) / total
+      score.Score = score.Days * (1 + score.DescriptionShare + score.ImageShare) / 3 / (1 + float64(score.Problems) / total)
+    }
+
+    scores = append(scores, score)
+  }
+
+  // equal scores keep order of -input
+  sort.SliceStable(scores, func(i, j int) bool {
+    return scores[i].Score > scores[j].Score
+  })
+
+  sourceScores[chId] = scores
+
+  order := make([]int, len(scores))
+
+  for pos, score := range scores {
+    order[pos] = score.Source
+  }
+
+  return order
+}
+
+func reportSources() {
+  if sourceSpans == nil {
+    return
+  }
+
+  fmt.Printf("Sources of EPG data:\n")
+
+  for pos, name := range sourceNames {
+    fmt.Printf("  %d: %s\n", pos + 1, name)
+  }
+
+  channels := make([]string, 0, len(sourceSpans))
+
+  for chId, _ := range sourceSpans {
+    channels = append(channels, chId)
+  }
+
+  sort.Strings(channels)
+
+  for _, chId := range channels {
+    var b strings.Builder
+
+    for pos, span := range sourceSpans[chId] {
+      if pos != 0 {
+        b.WriteString(", ")
+      }
+
+      b.WriteString(s("%d (%s - %s)", span.Source + 1,
+        time.Unix(span.StartTime, 0).In(localLocation).Format(eltDateFormat),
+        time.Unix(span.EndTime, 0).In(localLocation).Format(eltDateFormat)))
+    }
+
+    fmt.Printf("  %s: %s\n", chId, b.String())
+
+    if scores, ok := sourceScores[chId]; ok {
+      b.Reset()
+
+      for pos, score := range scores {
+        if pos != 0 {
+          b.WriteString(", ")
+        }
+
+        b.WriteString(s("%d: %.2f (%.1f days, %.0f%% descriptions, %.0f%% images, %d overlaps and gaps)", score.Source + 1,
+          score.Score, score.Days, score.DescriptionShare * 100, score.ImageShare * 100, score.Problems))
+      }
+
+      fmt.Printf("    scores %s\n", b.String())
+    }
+  }
+}
+
+func finishDb(ctx *RequestContext, dbNam string) error {
+  if (ctx.appendedElements == 0) {
+    emptyErrStr := fmt.Sprintf("no elements within specified period (%s)", startFrom.Format(eltDateFormat))
+
+    if (dbLastDate != nil) {
+      emptyErrStr += fmt.Sprintf(", last slot is at %s", (*dbLastDate).Format(eltDateFormat))
+    }
+
+    if (dbEarliestDate != nil) {
+      emptyErrStr += fmt.Sprintf(", first slot is at %s", (*dbEarliestDate).Format(eltDateFormat))
+    }
+
+    return errors.New(s("%s\n", emptyErrStr))
+  }
+
+  var err error
+
+  db := ctx.db
 
   tagMap := ctx.tagMap
 
-  bulkTx, txErr := db.Begin()
-  if txErr != nil {
-    return errors.New(s("Could not start transaction\n %s\n", txErr.Error()))
+  bulkTx, txErr := db.Begin()
+  if txErr != nil {
+    return errors.New(s("Could not start transaction\n %s\n", txErr.Error()))
+  }
+
+  if *fakeEnd != "" {
+    emptyStrId := ctx.stringMap[*fakeEnd]
+
+    if emptyStrId == 0 {
+      // allocate from the same counter as everything else, so that
+      // strings, inserted later, don't get the same docid
+      emptyStrId = ctx.textIdMax
+      ctx.textIdMax += 1
+
+      bulkTx.Exec("INSERT INTO text (docid, text) VALUES (?, ?);", emptyStrId, *fakeEnd)
+    }
+
+    fakeInsert, _ := bulkTx.Prepare(fmt.Sprintf("INSERT INTO search_meta_0 (start_time, ch_id, title_id, description_id, tags) VALUES (?, ?, %d, %d, 0);", emptyStrId, emptyStrId))
+
+    for chI, chEnd := range ctx.endMap {
+      // stop time of the last programme, with channel time offset already applied
+      if !chEnd.EndTime.Valid {
+        continue
+      }
+
+      fakeInsert.Exec(chEnd.EndTime.Int64, chI)
+    }
+  }
+
+  // remember programmes without "stop" attribute, so that their ends follow
+  // the next programme, if it gets dropped as overlapping
+  derivedEnds := make(map[int64]struct{})
+
+  derivedRows, queryErr := bulkTx.Query("SELECT _id FROM search_meta_0 WHERE end_time IS NULL;")
+  if queryErr != nil {
+    return errors.New(s("Failed to request EPG rows from database\n %s\n", queryErr.Error()))
+  }
+
+  for derivedRows.Next() {
+    var derivedId int64
+
+    scanErr := derivedRows.Scan(&derivedId)
+    if scanErr != nil {
+      derivedRows.Close()
+      return errors.New(s("SQLite error\n %s\n", scanErr.Error()))
+    }
+
+    derivedEnds[derivedId] = struct{}{}
+  }
+
+  derivedRows.Close()
+
+  // programmes without "stop" attribute last until the next one starts
+  // (fake entries above are taken into account, so the last one also gets it's end)
+  _, err = bulkTx.Exec("UPDATE search_meta_0 SET end_time = (SELECT MIN(next.start_time) FROM search_meta_0 next WHERE next.ch_id = search_meta_0.ch_id AND next.start_time > search_meta_0.start_time) WHERE end_time IS NULL;")
+  if err != nil {
+    return errors.New(s("Failed to compute end times\n %s\n", err.Error()))
+  }
+
+  err = applyEnrichment(ctx, bulkTx)
+  if err != nil {
+    return err
+  }
+
+  err = resolveOverlaps(ctx, bulkTx, derivedEnds)
+  if err != nil {
+    return err
+  }
+
+  tagList := make([]string, 0, len(tagMap))
+
+  for tag, _ := range tagMap {
+    tagList = append(tagList, tag)
+  }
+
+  sort.Slice(tagList, func(i, j int) bool {
+    left := tagMap[tagList[i]].NumberOfUses
+    right := tagMap[tagList[j]].NumberOfUses
+
+    if left > right {
+      return true
+    } else if left < right {
+      return false
+    }
+
+    return tagList[i] < tagList[j]
+  })
+
+  // sqlite supports only signed values, so we are limited to 63 bits
+  var usedBits [63]bool
+
+  if tagRegistryFile != "" {
+    // registered tags keep their bits, even if they are absent from this XMLTV
+    for _, bit := range tagRegistry {
+      usedBits[bit] = true
+    }
+  }
+
+  freeBit := 0
+  droppedTags := 0
+
+  for _, tag := range tagList {
+    pos, registered := tagRegistry[tag]
+
+    if !registered {
+      for freeBit < 63 && usedBits[freeBit] {
+        freeBit += 1
+      }
+
+      if freeBit > 62 {
+        // without junction table the tag would silently vanish from EPG
+        if tagRegistryFile != "" && !allTags {
+          return errors.New(s("Tag registry %s has no free bits for new tag '%s', all 63 of them are taken.\nRemove unused tags from the registry or use -all-tags\n", tagRegistryFile, tag))
+        }
+
+        droppedTags += 1
+        continue
+      }
+
+      pos = freeBit
+      usedBits[pos] = true
+
+      if tagRegistryFile != "" {
+        tagRegistry[tag] = pos
+        tagRegistryChanged = true
+      }
+    }
+
+    idVal := int64(1) << uint(pos)
+
+    //fmt.Printf("Adding new tag '%s' (value is %d, number of uses is %d)\n", tag, idVal, tagMap[tag].NumberOfUses)
+
+    _, tInsertErr := bulkTx.Stmt(ctx.sql6).Exec(idVal, tag)
+    if tInsertErr != nil {
+      return errors.New(s("Failed to insert into tags table: %s\n", tInsertErr.Error()))
+    }
+
+    tagMap[tag].IdVal = idVal
+  }
+
+  if allTags && !excludeTags {
+    // bitmask can't hold more than 63 tags, so all of them are also linked to programmes
+    // via junction table; bit column refers to tags table for those, that fit
+    _, err = bulkTx.Exec("CREATE TABLE tag_list (_id INTEGER PRIMARY KEY, tag TEXT NOT NULL, bit INTEGER)")
+    if err != nil {
+      return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
+    }
+
+    _, err = bulkTx.Exec("CREATE TABLE programme_tags (programme_id INTEGER NOT NULL, tag_id INTEGER NOT NULL)")
+    if err != nil {
+      return errors.New(s("CREATE TABLE failed\n %s\n", err.Error()))
+    }
+
+    for pos, tag := range tagList {
+      listId := int64(pos + 1)
+
+      _, tInsertErr := bulkTx.Exec("INSERT INTO tag_list (_id, tag, bit) VALUES (?, ?, ?);", listId, tag, sql.NullInt64{
+        Int64: tagMap[tag].IdVal,
+        Valid: tagMap[tag].IdVal != 0,
+      })
+      if tInsertErr != nil {
+        return errors.New(s("Failed to insert into tag_list table: %s\n", tInsertErr.Error()))
+      }
+
+      tagMap[tag].ListId = listId
+    }
+  }
+
+  bulkTxError := bulkTx.Commit()
+  if bulkTxError != nil {
+    return errors.New(s("Failed to commit final pass transaction\n %s\n", bulkTxError.Error()))
+  }
+
+  fmt.Printf("Inserted %d channels (%d archived), %d programm entries, %d unique strings\n", ctx.appendedChannels, archivedChannels, ctx.appendedElements, ctx.textIdMax)
+
+  if tagRegistryFile != "" {
+    if droppedTags != 0 {
+      fmt.Printf("WARNING: tag registry has no free bits, %d new tags were added only to programme_tags\n", droppedTags)
+    }
+  } else if (len(tagMap) > 63) {
+    if allTags {
+      fmt.Printf("Original XMLTV file has %d tags, the most popular 63 will be added to tags bitmask, all of them to programme_tags\n", len(tagMap))
+    } else {
+      fmt.Printf("Original XMLTV file has %d tags, the most popular 63 will be added to EPGX\n", len(tagMap))
+    }
+  }
+
+  if mappedTotal == 0 && len(idMap) != 0 {
+    fmt.Printf("WARNING: none of %d mappings were used!\n", len(idMap))
+  }
+
+  if archivedChannels == 0 && dvrLength == 0 {
+    fmt.Printf("WARNING: none of channels have archive!\n")
+  }
+
+  if badStopTimes != 0 {
+    fmt.Printf("WARNING: %d programmes have invalid stop time, it was derived from the next programme\n", badStopTimes)
+  }
+
+  reportSources()
+
+  reportChannels(true, s("programmes with duplicate start time were resolved (policy '%s')", duplicatePolicy), duplicateSlots)
+
+  reportChannels(false, "programmes were enriched from other XMLTV files", enrichedSlots)
+
+  reportChannels(true, s("programmes overlap with previous ones (policy '%s')", overlapPolicy), overlapSlots)
+
+  reportChannels(true, s("gaps longer than %s were filled with '%s'", gapFillerLength, gapFillerText), gapSlots)
+
+  reportUnknown("categories", "were kept as is", unmappedCategories)
+  reportUnknown("countries", "were not stored", unknownCountries)
+  reportUnknown("languages", "were not stored", unknownLanguages)
+
+  if len(dstAdjustments) != 0 {
+    fmt.Printf("WARNING: %d times fall on DST transitions:\n", len(dstAdjustments))
+
+    for pos, adjustment := range dstAdjustments {
+      if pos == 10 {
+        fmt.Printf("  ... and %d more\n", len(dstAdjustments) - pos)
+        break
+      }
+
+      fmt.Printf("  %s\n", adjustment)
+    }
+  }
+
+  if badStartTimes != 0 {
+    fmt.Printf("WARNING: %d programmes have invalid start time and were skipped\n", badStartTimes)
+  }
+
+  if badEpisodeNums != 0 {
+    fmt.Printf("WARNING: %d <episode-num> values could not be parsed\n", badEpisodeNums)
+  }
+
+  if (snippetLength >= 0) {
+     fmt.Printf("Trimmed %d characters. Max length before trimming: %d\n", trimmedTotal, snippetLengthMax)
+  }
+
+  rows, queryErr := db.Query("SELECT _id, tag_list FROM eltex_temp_search_tags")
+  if queryErr != nil {
+    return errors.New(s("Failed to request EPG rows from database\n %s\n", queryErr.Error()))
+  }
+
+  dbIds := make([]int64, 0)
+  dbCats := make([]int64, 0)
+  dbTagLinks := make([][2]int64, 0)
+
+  for rows.Next() {
+    var rowId int64
+    var rowCats string
+
+    scanErr := rows.Scan(&rowId, &rowCats)
+    if scanErr != nil {
+      return errors.New(s("SQLite error\n %s\n", scanErr.Error()))
+    }
+
+    dbIds = append(dbIds, rowId)
+
+    var catVal int64
+
+    catVal = 0
+
+    rowLinks := make(map[int64]struct{})
+
+    for _, catName := range strings.Split(rowCats, ",") {
+      if catName == "" {
+        continue
+      }
+
+      // same category may be listed several times for one programme
+      if listId := tagMap[catName].ListId; listId != 0 {
+        if _, linked := rowLinks[listId]; !linked {
+          rowLinks[listId] = struct{}{}
+
+          dbTagLinks = append(dbTagLinks, [2]int64{ rowId, listId })
+        }
+      }
+
+      catIdx := tagMap[catName].IdVal
+
+      if catIdx == 0 {
+        continue
+      }
+
+      catVal |= catIdx
+    }
+
+    dbCats = append(dbCats, catVal)
+  }
+
+  rows.Close()
+
+  caTx, caTxErr := db.Begin()
+  if caTxErr != nil {
+    return errors.New(s("Could not start transaction\n %s\n", caTxErr.Error()))
+  }
+
+  updateSql, prepErr := caTx.Prepare("UPDATE search_meta_0 SET tags = ? WHERE _id = ?;")
+  if prepErr != nil {
+    return errors.New(s("Prepare() failed: %s\n", prepErr.Error()))
+  }
+
+  for pos, itemId := range dbIds {
+    itemCatVal := dbCats[pos]
+
+    updateSql.Exec(itemCatVal, itemId)
+  }
+
+  if len(dbTagLinks) != 0 {
+    linkSql, linkPrepErr := caTx.Prepare("INSERT INTO programme_tags (programme_id, tag_id) VALUES (?, ?);")
+    if linkPrepErr != nil {
+      return errors.New(s("Prepare() failed: %s\n", linkPrepErr.Error()))
+    }
+
+    for _, tagLink := range dbTagLinks {
+      _, linkErr := linkSql.Exec(tagLink[0], tagLink[1])
+      if linkErr != nil {
+        return errors.New(s("Failed to insert into programme_tags table: %s\n", linkErr.Error()))
+      }
+    }
+  }
+
+  _, err = caTx.Exec("DROP TABLE eltex_temp_search_tags")
+  if err != nil {
+    return errors.New(s("Failed to delete aux table: %s\n", err.Error()))
+  }
+
+  _, err = caTx.Exec("DROP INDEX unique_start_time")
+  if err != nil {
+    Bail("Failed to drop aux index: %s\n", err.Error())
+  }
+
+  _, err = caTx.Exec("CREATE TABLE search_meta (_id INTEGER PRIMARY KEY, ch_id NOT NULL, start_time INTEGER NOT NULL, title_id INTEGER NOT NULL, description_id INTEGER NOT NULL, " + addOptionalCols() + "image_uri INTEGER" + addExtraCols() + ");")
+  if err != nil {
+    Bail("Failed to create dest table: %s\n", err.Error())
+  }
+
+  var copyBuilder strings.Builder
+
+  copyBuilder.WriteString("INSERT INTO search_meta SELECT _id, ch_id, start_time, title_id, description_id")
+  if (!excludeTags) {
+    copyBuilder.WriteString(", tags")
+  }
+  if (!excludeYear) {
+    copyBuilder.WriteString(", year")
+  }
+  copyBuilder.WriteString(", image_uri")
+  copyBuilder.WriteString(copyExtraCols())
+  copyBuilder.WriteString(" FROM search_meta_0")
+
+  _, err = caTx.Exec(copyBuilder.String())
+  if err != nil {
+    Bail("Failed to copy search_meta: %s\n", err.Error())
+  }
+
+  _, err = caTx.Exec("DROP TABLE search_meta_0")
+  if err != nil {
+    Bail("Failed to drop scratch table: %s\n", err.Error())
+  }
+
+  if (excludeTags) {
+    _, err = caTx.Exec("DROP TABLE tags")
+    if err != nil {
+      Bail("Failed to drop tags table: %s\n", err.Error())
+    }
+  }
+
+  caTxCommitErr := caTx.Commit()
+  if caTxCommitErr != nil {
+    return errors.New(s("Failed to commit tags transaction\n %s\n", caTxCommitErr.Error()))
+  }
+
+  return nil
+}
+
+func optimizeDatabase(ctx *RequestContext, dbNam string) error {
+  db := ctx.db
+
+  _, timeIdxErr := db.Exec(s("CREATE INDEX %s.time_idx ON search_meta (start_time);", dbNam))
+  if timeIdxErr != nil {
+    return errors.New(s("index creation failed\n %s\n", timeIdxErr.Error()))
+  }
+
+  _, indexErr := db.Exec(s("CREATE INDEX %s.ch_idx ON search_meta (ch_id, start_time);", dbNam))
+  if indexErr != nil {
+    return errors.New(s("index creation failed\n %s\n", indexErr.Error()))
+  }
+
+  _, indexErr2 := db.Exec(s("CREATE INDEX %s.description_idx ON search_meta (description_id);", dbNam))
+  if indexErr2 != nil {
+    return errors.New(s("index creation failed\n %s\n", indexErr2.Error()))
+  }
+
+  _, indexErr3 := db.Exec(s("CREATE INDEX %s.title_idx ON search_meta (title_id);", dbNam))
+  if indexErr3 != nil {
+    return errors.New(s("index creation failed\n %s\n", indexErr3.Error()))
+  }
+
+  if !excludeTags {
+    _, indexErr4 := db.Exec(s("CREATE INDEX %s.idx_tags ON search_meta(tags);", dbNam))
+    if indexErr4 != nil {
+      return errors.New(s("index creation failed\n %s\n", indexErr4.Error()))
+    }
+  }
+
+  _, indexErr5 := db.Exec(s("CREATE INDEX %s.credits_programme_idx ON credits (programme_id);", dbNam))
+  if indexErr5 != nil {
+    return errors.New(s("index creation failed\n %s\n", indexErr5.Error()))
+  }
+
+  _, indexErr6 := db.Exec(s("CREATE INDEX %s.credits_person_idx ON credits (person_id);", dbNam))
+  if indexErr6 != nil {
+    return errors.New(s("index creation failed\n %s\n", indexErr6.Error()))
+  }
+
+  _, indexErr9 := db.Exec(s("CREATE INDEX %s.programme_urls_idx ON programme_urls (programme_id);", dbNam))
+  if indexErr9 != nil {
+    return errors.New(s("index creation failed\n %s\n", indexErr9.Error()))
+  }
+
+  _, indexErr11 := db.Exec(s("CREATE INDEX %s.programme_images_idx ON programme_images (programme_id);", dbNam))
+  if indexErr11 != nil {
+    return errors.New(s("index creation failed\n %s\n", indexErr11.Error()))
+  }
+
+  _, indexErr10 := db.Exec(s("CREATE INDEX %s.programme_keywords_idx ON programme_keywords (keyword_id);", dbNam))
+  if indexErr10 != nil {
+    return errors.New(s("index creation failed\n %s\n", indexErr10.Error()))
+  }
+
+  if storeTranslations {
+    _, indexErr7 := db.Exec(s("CREATE INDEX %s.translations_programme_idx ON translations (programme_id);", dbNam))
+    if indexErr7 != nil {
+      return errors.New(s("index creation failed\n %s\n", indexErr7.Error()))
+    }
+  }
+
+  if allTags && !excludeTags {
+    _, indexErr12 := db.Exec(s("CREATE INDEX %s.programme_tags_idx ON programme_tags (tag_id);", dbNam))
+    if indexErr12 != nil {
+      return errors.New(s("index creation failed\n %s\n", indexErr12.Error()))
+    }
+  }
+
+  _, indexErr8 := db.Exec(s("CREATE INDEX %s.channel_aliases_idx ON channel_aliases (ch_id);", dbNam))
+  if indexErr8 != nil {
+    return errors.New(s("index creation failed\n %s\n", indexErr8.Error()))
+  }
+
+  _, optimizeErr := db.Exec(s("INSERT INTO %s.fts_search(fts_search) VALUES('optimize');", dbNam))
+  if optimizeErr != nil {
+    return errors.New(s("optimize() failed\n %s\n", optimizeErr.Error()))
+  }
+
+  _, optimizeErr2 := db.Exec(s("INSERT INTO %s.fts_channels(fts_channels) VALUES('optimize');", dbNam))
+  if optimizeErr2 != nil {
+    return errors.New(s("optimize() failed\n %s\n", optimizeErr2.Error()))
+  }
+
+  _, analyzeErr := db.Exec("ANALYZE;")
+  if analyzeErr != nil {
+    return errors.New(s("ANALYZE failed\n %s\n", analyzeErr.Error()))
+  }
+
+  _, vacuumErr := db.Exec("VACUUM;")
+  if vacuumErr != nil {
+    return errors.New(s("VACUUM failed\n %s\n", vacuumErr.Error()))
+  }
+
+  return nil
+}
+
+func parseChannelOffset(value string) (time.Duration, *time.Location, error) {
+  // "3" and "-1" are hours (as in older xmap files), "330m" are minutes,
+  // everything else is a name of IANA time zone, such as "Asia/Kolkata"
+  value = strings.TrimSpace(value)
+
+  if value == "" {
+    return 0, nil, nil
+  }
+
+  if hours, err := strconv.Atoi(value); err == nil {
+    return time.Duration(hours) * time.Hour, nil, nil
+  }
+
+  if strings.HasSuffix(value, "m") {
+    if minutes, err := strconv.Atoi(strings.TrimSuffix(value, "m")); err == nil {
+      return time.Duration(minutes) * time.Minute, nil, nil
+    }
+  }
+
+  zone, zoneErr := time.LoadLocation(value)
+  if zoneErr != nil {
+    return 0, nil, zoneErr
+  }
+
+  return 0, zone, nil
+}
+
+func parseXmltvDate(source string, zone *time.Location, after int64) (time.Time, int, error) {
+  // XMLTV dates are "loosely based on ISO 8601", which is rather poorly supported by Go
+  // so we have to do a bit of extra fiddling ourselves
+  //
+  // YYYY[MM[DD[hh[mm[ss]]]]], optionally followed by time zone: "+0300", "+03:00", "+03",
+  // "Z", "UTC" or "GMT", with or without space; omitted components are taken as zero
+
+  timeMatch := timeRegexp1.FindStringSubmatch(source)
+  if timeMatch == nil {
+    return time.Time{}, 0, errors.New(s("Failed to parse date: %s\n", source))
+  }
+
+  layout := "20060102150405"[:len(timeMatch[1])]
+
+  // time zone of channel takes precedence over -tz
+  if zone == nil {
+    zone = xmltvTzOverride
+  }
+
+  // DST transitions are resolved only in zones, given by -tz or xmap; offsets in XMLTV
+  // are fixed, and dates without them are trusted to be as good as Go can read them
+  resolveDst := zone != nil
+
+  if zone == nil {
+    zone = localLocation
+
+    if timeMatch[2] != "" {
+      offset, offsetErr := parseXmltvOffset(timeMatch[2])
+      if offsetErr != nil {
+        return time.Time{}, 0, errors.New(s("Failed to parse date: %s\n %s\n", source, offsetErr.Error()))
+      }
+
+      zone = time.FixedZone("", offset)
+    }
+  }
+
+  parsed, parseErr := time.ParseInLocation(layout, timeMatch[1], zone)
+  if parseErr != nil {
+    return time.Time{}, 0, errors.New(s("Failed to parse date: %s\n %s\n", source, parseErr.Error()))
+  }
+
+  if !resolveDst {
+    return parsed, 0, nil
+  }
+
+  // Go silently picks one of the offsets for ambiguous and nonexistent local times,
+  // which is wrong for half of programmes on the night of transition
+  // wall clock is taken from the source, because Go moves nonexistent times forward
+  //
+  // only the time before is known (start of the previous programme), so the earliest
+  // candidate after it is taken; without it, the time stays as Go picked it
+  wall, _ := time.ParseInLocation(layout, timeMatch[1], time.UTC)
+
+  candidates, dstKind := localTimeCandidates(wall, zone)
+  if dstKind == 0 {
+    return parsed, 0, nil
+  }
+
+  if after != 0 {
+    for _, candidate := range candidates {
+      if candidate.Unix() > after {
+        return candidate, dstKind, nil
+      }
+    }
+  }
+
+  return parsed, dstKind, nil
+}
+
+func localTimeCandidates(wall time.Time, zone *time.Location) ([]time.Time, int) {
+  // transitions are months apart, so offsets a day before and after are the ones
+  // in effect on both sides of any transition near the given time
+  offsets := make([]int, 0, 2)
+
+  for _, probe := range []time.Time{ wall.Add(-24 * time.Hour), wall.Add(24 * time.Hour) } {
+    _, offset := probe.In(zone).Zone()
+
+    if len(offsets) == 0 || offsets[0] != offset {
+      offsets = append(offsets, offset)
+    }
+  }
+
+  if len(offsets) == 1 {
+    return nil, 0
+  }
+
+  candidates := make([]time.Time, 0, 2)
+  moments := make([]time.Time, 0, 2)
+
+  for _, offset := range offsets {
+    moment := wall.Add(-time.Duration(offset) * time.Second).In(zone)
+    moments = append(moments, moment)
+
+    // moment with this offset shows the same wall clock only if the offset is in effect
+    if moment.Year() == wall.Year() && moment.YearDay() == wall.YearDay() && moment.Hour() == wall.Hour() && moment.Minute() == wall.Minute() {
+      candidates = append(candidates, moment)
+    }
+  }
+
+  dstKind := DstAmbiguous
+
+  switch len(candidates) {
+    case 1:
+      return nil, 0
+    case 0:
+      // the clock skips this time, programme is either before or after the jump
+      candidates = moments
+      dstKind = DstGap
+  }
+
+  sort.Slice(candidates, func(i, j int) bool {
+    return candidates[i].Before(candidates[j])
+  })
+
+  return candidates, dstKind
+}
+
+func parseXmltvOffset(value string) (int, error) {
+  switch strings.ToUpper(value) {
+    case "Z", "UTC", "GMT":
+      return 0, nil
+  }
+
+  digits := strings.ReplaceAll(value[1:], ":", "")
+
+  hours, _ := strconv.Atoi(digits[:2])
+  minutes := 0
+
+  if len(digits) > 2 {
+    minutes, _ = strconv.Atoi(digits[2:])
+  }
+
+  // real offsets range from -12:00 to +14:00
+  if hours > 14 || minutes > 59 {
+    return 0, errors.New(s("bad time zone offset %s", value))
+  }
+
+  offset := hours * 3600 + minutes * 60
+
+  if value[0] == '-' {
+    offset = -offset
+  }
+
+  return offset, nil
+}
+
+func isReadyForFts(c rune) (bool) {
+  // from https://www.sqlite.org/fts3.html
+  //
+  // A term is a contiguous sequence of eligible characters, where eligible characters are
+  // all alphanumeric characters and all characters with Unicode codepoint values greater
+  // than or equal to 128. All other characters are discarded
+
+  if (c >= 'a' && c <= 'z') {
+    return true;
+  }
+
+  if (c >= '0' && c <= '9') {
+    return true;
+  }
+
+  return c >= 128;
+}
+
+func ftsText(text string) (string) {
+  if useLegacyFormat {
+    // "simple" tokenizer folds only ASCII characters
+    text = strings.ToLower(text)
+    text = strings.ReplaceAll(text, "ё", "е")
+  }
+
+  return text
+}
+
+func preprocess(name string) (string) {
+  // replace punctuation and special characters with spaces
+  // and trim all resulting excess space from string
+
+  var builder strings.Builder
+
+  lastIsSpace := false
+
+  for _, c := range name {
+    if (c >= 'A' && c <= 'Z') {
+      c = c + ('a' - 'A');
+    } else if (c >= 'А' && c <= 'Я') {
+      // not necessary for FTS, just normalization for caller
+      c = c + ('я' - 'Я');
+    } else if (!isReadyForFts(c)) {
+      c = ' ';
+    }
+
+    if c == ' ' && lastIsSpace {
+      continue
+    }
+
+    lastIsSpace = c == ' '
+
+    builder.WriteRune(c);
+  }
+
+  return strings.TrimSpace(builder.String())
+}
+
+func addChannel(ctx *RequestContext, decoder *xml.Decoder, channel *Channel, xmlElement *xml.StartElement, bulkTx *sql.Tx) (bool, error) {
+  decErr := decoder.DecodeElement(channel, xmlElement)
+  if (decErr != nil) {
+    return false, errors.New(s("Could not decode element\n %s\n", decErr.Error()))
+  }
+
+  var imageUri sql.NullString
+
+  if channel.Icon.Uri != "" {
+    imageUri = sql.NullString{
+      String: channel.Icon.Uri,
+      Valid: true,
+    }
+  }
+
+  channelName := langText(channel.Names, pickLang(channel.Names))
+
+  if (channelName == "" || channel.Id == "") {
+    return false, nil
+  }
+
+  chId := channel.Id
+  archived := 0
+
+  var channelPage, homepage sql.NullString
+  var channelNumber sql.NullInt64
+
+  if lcn, lcnErr := strconv.Atoi(strings.TrimSpace(channel.Lcn)); lcnErr == nil && lcn > 0 {
+    channelNumber = nullableInt(lcn)
+  }
+
+  for _, channelUrl := range channel.Urls {
+    if channelUrl = strings.TrimSpace(channelUrl); channelUrl != "" {
+      homepage = sql.NullString{
+        String: channelUrl,
+        Valid: true,
+      }
+      break
+    }
+  }
+
+  if mappedId, ok := idMap[chId]; ok {
+    chId = mappedId.Id
+    archived = mappedId.ArchiveHours
+
+    if mappedId.ChannelNumber > 0 {
+      channelNumber = nullableInt(mappedId.ChannelNumber)
+    }
+
+    if mappedId.ImageUrlOverride != "" {
+      imageUri = sql.NullString{
+        String: mappedId.ImageUrlOverride,
+        Valid: true,
+      }
+    }
+
+    if mappedId.ChannelPage != "" {
+      channelPage = sql.NullString{
+        String: mappedId.ChannelPage,
+        Valid: true,
+      }
+    }
+  }
+
+  if archived == 0 {
+    archived = dvrLength
+  }
+
+  if len(channelWhitelist) != 0 {
+    if _, ok := channelWhitelist[chId]; !ok {
+      return false, nil
+    }
+  }
+
+  if _, blacklisted := channelBlacklist[chId]; blacklisted {
+    return false, nil
+  }
+
+  if archived > 0 {
+    archivedChannels += 1
+
+    // store archived time in seconds
+    archived *= 3600;
+  }
+
+  //fmt.Printf("Inserting %s, %s %s %d\n", chId, imageUri.String, channelName, archived)
+
+  chInsertRes, chInsertErr := bulkTx.Stmt(ctx.sql5).Exec(chId, imageUri, preprocess(channelName), archived, channelPage, channelNumber, homepage)
+  if chInsertErr != nil {
+    return false, errors.New(s("Failed to insert into channels table\n %s\n", chInsertErr.Error()))
+  }
+
+  // keep aliases even if channel is already known, other XMLTV files may call it differently
+  for _, alias := range channel.Names {
+    aliasErr := addChannelAlias(ctx, bulkTx, chId, alias.Text, alias.Lang)
+    if aliasErr != nil {
+      return false, aliasErr
+    }
+  }
+
+  rowsAffected, _ := chInsertRes.RowsAffected()
+
+  return rowsAffected != 0, nil;
+}
+
+func addChannelAlias(ctx *RequestContext, bulkTx *sql.Tx, chId string, alias string, lang string) error {
+  aliasName := preprocess(alias)
+  if aliasName == "" {
+    return nil
+  }
+
+  aliasKey := chId + "|" + aliasName
+
+  if _, seen := ctx.aliasMap[aliasKey]; seen {
+    return nil
+  }
+
+  ctx.aliasMap[aliasKey] = struct{}{}
+
+  var aliasLang sql.NullString
+
+  if lang != "" {
+    aliasLang = sql.NullString{
+      String: strings.ToLower(lang),
+      Valid: true,
+    }
+  }
+
+  aliasRes, aliasErr := bulkTx.Stmt(ctx.sql10).Exec(chId, aliasName, aliasLang)
+  if aliasErr != nil {
+    return errors.New(s("Failed to insert into channel_aliases table\n %s\n", aliasErr.Error()))
+  }
+
+  aliasId, _ := aliasRes.LastInsertId()
+
+  _, ftsErr := bulkTx.Stmt(ctx.sql11).Exec(aliasId, ftsText(aliasName))
+  if ftsErr != nil {
+    return errors.New(s("FTS INSERT failed\n %s\n", ftsErr.Error()))
+  }
+
+  return nil
+}
+
+func addElement(ctx *RequestContext, decoder *xml.Decoder, programme *Programm, xmlElement *xml.StartElement, bulkTx *sql.Tx) (bool, error) {
+  decErr := decoder.DecodeElement(programme, xmlElement)
+  if (decErr != nil) {
+    return false, errors.New(s("Could not decode element\n %s\n", decErr.Error()))
+  }
+
+  chId, startTime, endTime, slotFlags := programmeSlot(programme.Channel, programme.Start, programme.End, ctx.lastStarts)
+
+  if slotFlags & (SlotDstAmbiguous | SlotDstGap) != 0 {
+    kind := "ambiguous"
+    if slotFlags & SlotDstGap != 0 {
+      kind = "nonexistent"
+    }
+
+    resolution := "resolved by previous programme"
+    if slotFlags & SlotDstUnresolved != 0 {
+      resolution = "unresolved, no previous programme"
+    }
+
+    dstAdjustments = append(dstAdjustments, s("%s: start %s is %s, %s, taken as %s", chId, programme.Start, kind, resolution, startTime.Format(time.RFC3339)))
+  }
+
+  if slotFlags & SlotStopDst != 0 && endTime.Valid {
+    dstAdjustments = append(dstAdjustments, s("%s: stop %s falls on DST transition, resolved by start, taken as %s", chId, programme.End, time.Unix(endTime.Int64, 0).In(localLocation).Format(time.RFC3339)))
+  }
+
+  if slotFlags & SlotMapped != 0 {
+    mappedTotal += 1
+  }
+
+  if slotFlags & SlotBadStop != 0 {
+    badStopTimes += 1
+  }
+
+  if slotFlags & SlotBadStart != 0 {
+    badStartTimes += 1
+
+    if badStartTimes <= 10 {
+      fmt.Fprintf(os.Stderr, "Failed to parse start time '%s' of programme on channel '%s'\n", programme.Start, programme.Channel)
+    }
+  }
+
+  if slotFlags & SlotBeforeSpan != 0 {
+    if (dbLastDate == nil || startTime.After(*dbLastDate)) {
+      dbLastDate = &startTime
+    }
+  }
+
+  if slotFlags & SlotAfterSpan != 0 {
+    if (dbEarliestDate == nil || startTime.Before(*dbEarliestDate)) {
+      dbEarliestDate = &startTime
+    }
+  }
+
+  if slotFlags & SlotSkipped != 0 {
+    return false, nil
+  }
+
+  if acceptedSlots != nil {
+    if _, accepted := acceptedSlots[SourceSlot{ chId, ctx.source, startTime.Unix() }]; !accepted {
+      // this time is covered by source with higher priority, but the programme
+      // still may have something, that is missing there
+      if enrichProgrammes {
+        return false, addEnrichment(ctx, programme, chId, startTime, bulkTx)
+      }
+
+      return false, nil
+    }
+  }
+
+  var replacedId, mergeId, mergeDescrId int64
+
+  if duplicatePolicy != "fail" {
+    var dupId, dupDescrId int64
+    var dupEnd sql.NullInt64
+
+    dupErr := bulkTx.Stmt(ctx.sql15).QueryRow(chId, startTime.Unix()).Scan(&dupId, &dupEnd, &dupDescrId)
+    if dupErr == nil {
+      duplicateSlots[chId] += 1
+
+      switch duplicatePolicy {
+        case "first":
+          return false, nil
+        case "longest":
+          // unknown duration loses to any known one, ties are won by the first programme
+          var newLength, oldLength int64
+
+          if endTime.Valid {
+            newLength = endTime.Int64 - startTime.Unix()
+          }
+
+          if dupEnd.Valid {
+            oldLength = dupEnd.Int64 - startTime.Unix()
+          }
+
+          if newLength <= oldLength {
+            return false, nil
+          }
+
+          replacedId = dupId
+        case "last":
+          replacedId = dupId
+        case "merge":
+          mergeId = dupId
+          mergeDescrId = dupDescrId
+      }
+    } else if dupErr != sql.ErrNoRows {
+      return false, errors.New(s("Failed to look up duplicate programmes\n %s\n", dupErr.Error()))
+    }
+  }
+
+  if replacedId != 0 {
+    deleteErr := deleteElement(ctx, replacedId, bulkTx)
+    if deleteErr != nil {
+      return false, deleteErr
+    }
+  }
+
+  lastEnd := ctx.endMap[chId]
+
+  if lastEnd == nil || lastEnd.StartTime < startTime.Unix() {
+    ctx.endMap[chId] = &EndMeta{
+      StartTime: startTime.Unix(),
+      EndTime: endTime,
+    }
+  }
+
+  titlePos := pickLang(programme.Titles)
+
+  programme.Title = langText(programme.Titles, titlePos)
+  programme.SubTitle = langText(programme.SubTitles, pickLang(programme.SubTitles))
+  programme.Description = langText(programme.Descriptions, pickLang(programme.Descriptions))
+
+  // other languages go to translations table, so clients need to know this one
+  var titleLang sql.NullString
+
+  if titlePos >= 0 && programme.Titles[titlePos].Lang != "" {
+    titleLang = sql.NullString{
+      String: strings.ToLower(programme.Titles[titlePos].Lang),
+      Valid: true,
+    }
+  }
+
+  parseEpisodeNums(programme)
+  parseAgeRating(programme)
+
+  progTitle := programme.Title
+
+  if compiledTemplate != nil {
+    var buff bytes.Buffer
+
+    tmplErr := compiledTemplate.Execute(&buff, programme)
+    if tmplErr == nil {
+      progTitle = buff.String()
+    }
+  }
+
+  textInsert := bulkTx.Stmt(ctx.sql4)
+  ftsInsert := bulkTx.Stmt(ctx.sql2)
+  uriInsert := bulkTx.Stmt(ctx.sql3)
+  metaInsert := bulkTx.Stmt(ctx.sql1)
+  tagInsert := bulkTx.Stmt(ctx.sql7)
+
+  var imageDbId sql.NullInt64
+
+  firstUri := firstImageUri(programme)
+
+  if firstUri != "" {
+    uriId, uriErr := addUri(ctx, uriInsert, rewriteImageUrl(firstUri))
+    if uriErr != nil {
+      return false, uriErr
+    }
+
+    imageDbId = sql.NullInt64{
+      Int64: uriId,
+      Valid: true,
+    }
+  }
+
+  progCategories, contentNibble := mapCategories(programme.Categories)
+
+  for _, category := range progCategories {
+    tagInfo := ctx.tagMap[category]
+
+    if tagInfo == nil {
+      newTagInfo := TagMeta{
+        NumberOfUses: 1,
+        IdVal: 0,
+      }
+
+      ctx.tagMap[category] = &newTagInfo
+
+      //fmt.Printf("Adding new tag %s for %s\n", category, progTitle)
+    } else {
+      tagInfo.NumberOfUses += 1
+    }
+  }
+
+  var caStr strings.Builder
+
+  for _, ca := range progCategories {
+    caStr.WriteString(ca)
+    caStr.WriteString(",")
+  }
+
+  catsColumn := caStr.String()
+
+  progYear := parseYear(programme.Year)
+
+  var ageRating sql.NullInt64
+
+  if programme.AgeRating >= 0 {
+    ageRating = sql.NullInt64{
+      Int64: int64(programme.AgeRating),
+      Valid: true,
+    }
+  }
+
+  adult := 0
+  if programme.AgeRating >= 18 {
+    adult = 1
+  }
+
+  var progCountry, progLanguage, progOrigLanguage sql.NullString
+
+  countryList := make([]string, 0)
+
+  for _, rawCountry := range programme.Countries {
+    for _, code := range normalizeCountries(rawCountry) {
+      countryList = append(countryList, code)
+    }
+  }
+
+  if len(countryList) != 0 {
+    progCountry = sql.NullString{
+      String: strings.Join(countryList, ","),
+      Valid: true,
+    }
+  }
+
+  if code := normalizeLanguage(programme.Language); code != "" {
+    progLanguage = sql.NullString{
+      String: code,
+      Valid: true,
+    }
+  }
+
+  if code := normalizeLanguage(programme.OrigLanguage); code != "" {
+    progOrigLanguage = sql.NullString{
+      String: code,
+      Valid: true,
+    }
+  }
+
+  var aspectRatio sql.NullString
+
+  if aspect := strings.TrimSpace(programme.Video.Aspect); aspect != "" {
+    aspectRatio = sql.NullString{
+      String: aspect,
+      Valid: true,
+    }
+  }
+
+  if mergeId != 0 {
+    // title of duplicate is dropped, it's description is stored only if the first programme has none
+    if mergeDescrId == ctx.stringMap[""] && programme.Description != "" {
+      var descrErr error
+
+      mergeDescrId, descrErr = addDescription(ctx, textInsert, ftsInsert, programme.Description)
+      if descrErr != nil {
+        return false, descrErr
+      }
+    }
+
+    return false, mergeElement(ctx, programme, mergeId, bulkTx, catsColumn,
+      mergeDescrId, imageDbId, progYear,
+      nullableNumber(programme.Season), nullableInt(programme.SeasonTotal),
+      nullableNumber(programme.Episode), nullableInt(programme.EpisodeTotal),
+      nullableNumber(programme.Part), nullableInt(programme.PartTotal),
+      ageRating, adult, endTime, programmeFlags(programme),
+      videoQuality(programme.Video.Quality), aspectRatio, yesNo(programme.Video.Colour),
+      audioKind(&programme.Audio), subtitleKinds(programme.Subtitles),
+      progCountry, progLanguage, progOrigLanguage, lengthSeconds(&programme.Length),
+      contentNibble)
+  }
+
+  titleId, titleErr := addText(ctx, textInsert, ftsInsert, progTitle)
+  if titleErr != nil {
+    return false, titleErr
+  }
+
+  descrId, descrErr := addDescription(ctx, textInsert, ftsInsert, programme.Description)
+  if descrErr != nil {
+    return false, descrErr
+  }
+
+  metaRes, metaErr := metaInsert.Exec(startTime.Unix(), chId, imageDbId, titleId, descrId, progYear, 0,
+    nullableNumber(programme.Season), nullableInt(programme.SeasonTotal),
+    nullableNumber(programme.Episode), nullableInt(programme.EpisodeTotal),
+    nullableNumber(programme.Part), nullableInt(programme.PartTotal),
+    ageRating, adult, endTime, programmeFlags(programme),
+    videoQuality(programme.Video.Quality), aspectRatio, yesNo(programme.Video.Colour),
+    audioKind(&programme.Audio), subtitleKinds(programme.Subtitles),
+    progCountry, progLanguage, progOrigLanguage, lengthSeconds(&programme.Length),
+    contentNibble, titleLang)
+  if (metaErr != nil) {
+    fmt.Printf("When parsing %s\n", programme.Title)
+
+    return false, errors.New(s("Meta INSERT failed\n %s\n", metaErr.Error()))
+  }
+
+  insertId, _ := metaRes.LastInsertId()
+
+  _, tagsErr := tagInsert.Exec(insertId, catsColumn)
+  if tagsErr != nil {
+    return false, errors.New(s("Tag INSERT failed\n %s\n", tagsErr.Error()))
+  }
+
+  creditsErr := addCredits(ctx, &programme.Credits, insertId, bulkTx, nil)
+  if creditsErr != nil {
+    return false, creditsErr
+  }
+
+  linksErr := addLinks(ctx, programme, insertId, bulkTx)
+  if linksErr != nil {
+    return false, linksErr
+  }
+
+  imagesErr := addImages(ctx, programme, insertId, bulkTx, nil)
+  if imagesErr != nil {
+    return false, imagesErr
+  }
+
+  if storeTranslations {
+    translationsErr := addTranslations(ctx, programme, insertId, bulkTx)
+    if translationsErr != nil {
+      return false, translationsErr
+    }
+  }
+
+  // replaced programme was already counted
+  return replacedId == 0, nil
+}
+
+type SlotMeta struct {
+  Id                   int64
+  ChId                 string
+  StartTime            int64
+  EndTime              sql.NullInt64
+}
+
+func resolveOverlaps(ctx *RequestContext, bulkTx *sql.Tx, derivedEnds map[int64]struct{}) error {
+  // with "keep" policy overlaps are only counted for the report
+  rows, queryErr := bulkTx.Query("SELECT _id, ch_id, start_time, end_time FROM search_meta_0 ORDER BY ch_id, start_time;")
+  if queryErr != nil {
+    return errors.New(s("Failed to request EPG rows from database\n %s\n", queryErr.Error()))
+  }
+
+  slots := make([]SlotMeta, 0)
+
+  for rows.Next() {
+    var slot SlotMeta
+
+    scanErr := rows.Scan(&slot.Id, &slot.ChId, &slot.StartTime, &slot.EndTime)
+    if scanErr != nil {
+      rows.Close()
+      return errors.New(s("SQLite error\n %s\n", scanErr.Error()))
+    }
+
+    slots = append(slots, slot)
+  }
+
+  rows.Close()
+
+  trimSql, prepErr := bulkTx.Prepare("UPDATE search_meta_0 SET end_time = ? WHERE _id = ?;")
+  if prepErr != nil {
+    return errors.New(s("Prepare() failed: %s\n", prepErr.Error()))
+  }
+
+  kept := make([]*SlotMeta, 0, len(slots))
+
+  for i := range slots {
+    slot := &slots[i]
+
+    if len(kept) == 0 || kept[len(kept) - 1].ChId != slot.ChId {
+      kept = append(kept, slot)
+      continue
+    }
+
+    prev := kept[len(kept) - 1]
+
+    if !prev.EndTime.Valid || prev.EndTime.Int64 <= slot.StartTime {
+      kept = append(kept, slot)
+      continue
+    }
+
+    overlapSlots[slot.ChId] += 1
+
+    dropShorter := overlapPolicy == "drop-shorter"
+
+    if dropShorter && !slot.EndTime.Valid {
+      // length of the last entry (such as "end of programme" one) is unknown,
+      // there is nothing to compare, so previous programme is trimmed instead
+      dropShorter = false
+    }
+
+    if dropShorter {
+      if slot.EndTime.Int64 - slot.StartTime <= prev.EndTime.Int64 - prev.StartTime {
+        deleteErr := deleteElement(ctx, slot.Id, bulkTx)
+        if deleteErr != nil {
+          return deleteErr
+        }
+
+        continue
+      }
+
+      deleteErr := deleteElement(ctx, prev.Id, bulkTx)
+      if deleteErr != nil {
+        return deleteErr
+      }
+
+      // programme before the dropped one ended before it started, so it can't overlap this one
+      kept[len(kept) - 1] = slot
+    } else {
+      if overlapPolicy == "trim" {
+        prev.EndTime.Int64 = slot.StartTime
+
+        _, trimErr := trimSql.Exec(prev.EndTime.Int64, prev.Id)
+        if trimErr != nil {
+          return errors.New(s("Failed to trim overlapping programme\n %s\n", trimErr.Error()))
+        }
+      }
+
+      kept = append(kept, slot)
+    }
+  }
+
+  if overlapPolicy == "drop-shorter" {
+    // end times, that were derived from start of dropped programme, now point into
+    // a hole in schedule, so they are derived again from the remaining programmes
+    for i := 0; i + 1 < len(kept); i++ {
+      slot := kept[i]
+      next := kept[i + 1]
+
+      if _, derived := derivedEnds[slot.Id]; !derived || slot.ChId != next.ChId {
+        continue
+      }
+
+      if slot.EndTime.Valid && slot.EndTime.Int64 == next.StartTime {
+        continue
+      }
+
+      slot.EndTime = sql.NullInt64{
+        Int64: next.StartTime,
+        Valid: true,
+      }
+
+      _, trimErr := trimSql.Exec(slot.EndTime.Int64, slot.Id)
+      if trimErr != nil {
+        return errors.New(s("Failed to update end of programme\n %s\n", trimErr.Error()))
+      }
+    }
+  }
+
+  if gapFillerLength <= 0 {
+    return nil
+  }
+
+  // text of placeholders is added along with the first of them, so that it isn't left unused
+  var fillerInsert *sql.Stmt
+
+  // with "keep" policy an earlier long programme may cover several later ones,
+  // so gaps are measured from the latest end in the channel, not the previous one
+  var maxEnd int64
+
+  for i := 0; i < len(kept); i++ {
+    slot := kept[i]
+
+    if i == 0 || kept[i - 1].ChId != slot.ChId {
+      maxEnd = 0
+    }
+
+    prev := maxEnd
+
+    if slot.EndTime.Valid && slot.EndTime.Int64 > maxEnd {
+      maxEnd = slot.EndTime.Int64
+    }
+
+    // only gaps between programmes are filled, nothing is known about time outside of schedule
+    if i == 0 || kept[i - 1].ChId != slot.ChId || !kept[i - 1].EndTime.Valid {
+      continue
+    }
+
+    if time.Duration(slot.StartTime - prev) * time.Second < gapFillerLength {
+      continue
+    }
+
+    if fillerInsert == nil {
+      fillerId := ctx.stringMap[gapFillerText]
+
+      if fillerId == 0 {
+        // same as fake end entries, placeholders aren't searchable
+        fillerId = ctx.textIdMax
+        ctx.textIdMax += 1
+
+        ctx.stringMap[gapFillerText] = fillerId
+
+        _, textErr := bulkTx.Exec("INSERT INTO text (docid, text) VALUES (?, ?);", fillerId, gapFillerText)
+        if textErr != nil {
+          return errors.New(s("text INSERT failed\n %s\n", textErr.Error()))
+        }
+      }
+
+      fillerInsert, prepErr = bulkTx.Prepare(s("INSERT INTO search_meta_0 (start_time, ch_id, title_id, description_id, tags, end_time) VALUES (?, ?, %d, %d, 0, ?);", fillerId, fillerId))
+      if prepErr != nil {
+        return errors.New(s("Prepare() failed: %s\n", prepErr.Error()))
+      }
+    }
+
+    _, fillerErr := fillerInsert.Exec(prev, slot.ChId, slot.StartTime)
+    if fillerErr != nil {
+      return errors.New(s("Failed to insert gap filler\n %s\n", fillerErr.Error()))
+    }
+
+    gapSlots[slot.ChId] += 1
+  }
+
+  return nil
+}
+
+const (
+  SlotMapped = 1 << iota
+  SlotBadStop
+  SlotBadStart
+  SlotSkipped
+  SlotDstAmbiguous
+  SlotDstGap
+  SlotStopDst
+  SlotDstUnresolved
+  SlotBeforeSpan
+  SlotAfterSpan
+)
+
+const (
+  DstAmbiguous = 1
+  DstGap = 2
+)
+
+func programmeSlot(xmltvId string, start string, stop string, lastStarts map[string]int64) (string, time.Time, sql.NullInt64, int) {
+  // channel and time of programme after applying mappings and filters, shared by
+  // addElement and scanSource, so that both agree on what ends up in EPG
+
+  var chOffset time.Duration
+  var chZone *time.Location
+  var endTime sql.NullInt64
+
+  slotFlags := 0
+
+  chId := xmltvId
+
+  if mappedId, ok := idMap[chId]; ok {
+    chId = mappedId.Id
+    chOffset = mappedId.TimeOffset
+    chZone = mappedId.TimeZone
+
+    slotFlags |= SlotMapped
+  }
+
+  if len(channelWhitelist) != 0 {
+    if _, ok := channelWhitelist[chId]; !ok {
+      return chId, time.Time{}, endTime, slotFlags | SlotSkipped
+    }
+  }
+
+  if _, blacklisted := channelBlacklist[chId]; blacklisted {
+    return chId, time.Time{}, endTime, slotFlags | SlotSkipped
+  }
+
+  // times, which are ambiguous or don't exist because of DST transition, are resolved
+  // so that programme starts after the previous one in the same channel
+  lastStart := lastStarts[xmltvId]
+
+  startTime, startDst, timeErr := parseXmltvDate(start, chZone, lastStart)
+  if (timeErr != nil) {
+    // one broken programme should not stop the whole conversion
+    return chId, startTime, endTime, slotFlags | SlotBadStart | SlotSkipped
+  }
+
+  // stop is in the same time scale as start, before channel offset is applied
+  rawStart := startTime.Unix()
+
+  lastStarts[xmltvId] = rawStart
+
+  switch startDst {
+    case DstAmbiguous:
+      slotFlags |= SlotDstAmbiguous
+    case DstGap:
+      slotFlags |= SlotDstGap
+  }
+
+  // the first programme of channel has nothing to be ordered after
+  if startDst != 0 && lastStart == 0 {
+    slotFlags |= SlotDstUnresolved
+  }
+
+  startTime = startTime.Add(chOffset).In(localLocation)
+
+  if stop != "" {
+    stopTime, stopDst, stopErr := parseXmltvDate(stop, chZone, rawStart)
+    if stopDst != 0 {
+      slotFlags |= SlotStopDst
+    }
+
+    // stop time, that isn't after the start, is as useless as unparsable one
+    if stopErr != nil || !stopTime.Add(chOffset).After(startTime) {
+      slotFlags |= SlotBadStop
+    } else {
+      endTime = sql.NullInt64{
+        Int64: stopTime.Add(chOffset).Unix(),
+        Valid: true,
+      }
+    }
+  }
+
+  // reported by caller, scanSource must not leave traces in the report
+  if (startTime.Before(startFrom)) {
+    return chId, startTime, endTime, slotFlags | SlotBeforeSpan | SlotSkipped
+  }
+
+  if (startFrom.Add(spanDuration).Before(startTime)) {
+    return chId, startTime, endTime, slotFlags | SlotAfterSpan | SlotSkipped
+  }
+
+  return chId, startTime, endTime, slotFlags
+}
+
+func addEnrichment(ctx *RequestContext, programme *Programm, chId string, startTime time.Time, bulkTx *sql.Tx) error {
+  title := langText(programme.Titles, pickLang(programme.Titles))
+  description := langText(programme.Descriptions, pickLang(programme.Descriptions))
+  image := firstImageUri(programme)
+  year := parseYear(programme.Year)
+
+  if title == "" || (description == "" && image == "" && !year.Valid) {
+    return nil
+  }
+
+  // programmes from more trusted files are used first
+  rank := 0
+
+  for pos, source := range channelOrders[chId] {
+    if source == ctx.source {
+      rank = pos
+    }
+  }
+
+  _, enrichErr := bulkTx.Stmt(ctx.sql17).Exec(chId, startTime.Unix(), rank, title,
+    sql.NullString{ String: description, Valid: description != "" },
+    sql.NullString{ String: image, Valid: image != "" }, year)
+  if enrichErr != nil {
+    return errors.New(s("Failed to store programme for enrichment\n %s\n", enrichErr.Error()))
+  }
+
+  return nil
+}
+
+func similarTitles(left string, right string) bool {
+  // titles from different providers differ in punctuation, case and suffixes
+  // (such as episode numbers), so most of words of the shorter one is enough
+  left = preprocess(left)
+  right = preprocess(right)
+
+  if left == "" || right == "" {
+    return false
+  }
+
+  if strings.Contains(left, right) || strings.Contains(right, left) {
+    return true
+  }
+
+  leftWords := strings.Fields(left)
+  rightWords := strings.Fields(right)
+
+  if len(leftWords) > len(rightWords) {
+    leftWords, rightWords = rightWords, leftWords
+  }
+
+  rightSet := make(map[string]struct{}, len(rightWords))
+
+  for _, word := range rightWords {
+    rightSet[word] = struct{}{}
+  }
+
+  common := 0
+
+  for _, word := range leftWords {
+    if _, ok := rightSet[word]; ok {
+      common += 1
+    }
+  }
+
+  return common * 2 > len(leftWords)
+}
+
+type EnrichMeta struct {
+  ChId                 string
+  StartTime            int64
+  Title                string
+  Description          sql.NullString
+  Image                sql.NullString
+  Year                 sql.NullInt64
+}
+
+func applyEnrichment(ctx *RequestContext, bulkTx *sql.Tx) error {
+  rows, queryErr := bulkTx.Query("SELECT ch_id, start_time, title, description, image, year FROM eltex_temp_enrich ORDER BY rank, ch_id, start_time;")
+  if queryErr != nil {
+    return errors.New(s("Failed to request enrichment rows from database\n %s\n", queryErr.Error()))
+  }
+
+  candidates := make([]EnrichMeta, 0)
+
+  for rows.Next() {
+    var candidate EnrichMeta
+
+    scanErr := rows.Scan(&candidate.ChId, &candidate.StartTime, &candidate.Title, &candidate.Description, &candidate.Image, &candidate.Year)
+    if scanErr != nil {
+      rows.Close()
+      return errors.New(s("SQLite error\n %s\n", scanErr.Error()))
+    }
+
+    candidates = append(candidates, candidate)
+  }
+
+  rows.Close()
+
+  _, dropErr := bulkTx.Exec("DROP TABLE eltex_temp_enrich")
+  if dropErr != nil {
+    return errors.New(s("Failed to delete aux table: %s\n", dropErr.Error()))
+  }
+
+  if len(candidates) == 0 {
+    return nil
+  }
+
+  matchSql, prepErr := bulkTx.Prepare("SELECT m._id, m.start_time, t.text, m.description_id, m.image_uri, m.year FROM search_meta_0 m JOIN text t ON t.docid = m.title_id WHERE m.ch_id = ? AND m.start_time BETWEEN ? AND ?;")
+  if prepErr != nil {
+    return errors.New(s("Prepare() failed: %s\n", prepErr.Error()))
+  }
+
+  updateSql, prepErr := bulkTx.Prepare("UPDATE search_meta_0 SET description_id = ?, image_uri = ?, year = ? WHERE _id = ?;")
+  if prepErr != nil {
+    return errors.New(s("Prepare() failed: %s\n", prepErr.Error()))
+  }
+
+  textInsert := bulkTx.Stmt(ctx.sql4)
+  ftsInsert := bulkTx.Stmt(ctx.sql2)
+  uriInsert := bulkTx.Stmt(ctx.sql3)
+  imageInsert := bulkTx.Stmt(ctx.sql14)
+
+  window := int64(enrichWindow / time.Second)
+
+  // programmes without description refer to empty string
+  emptyId, hasEmpty := ctx.stringMap[""]
+
+  for _, candidate := range candidates {
+    matches, matchErr := matchSql.Query(candidate.ChId, candidate.StartTime - window, candidate.StartTime + window)
+    if matchErr != nil {
+      return errors.New(s("Failed to request EPG rows from database\n %s\n", matchErr.Error()))
+    }
+
+    var bestId, bestDistance, descrId int64
+    var imageId, year sql.NullInt64
+
+    for matches.Next() {
+      var rowId, rowStart, rowDescrId int64
+      var rowTitle string
+      var rowImageId, rowYear sql.NullInt64
+
+      scanErr := matches.Scan(&rowId, &rowStart, &rowTitle, &rowDescrId, &rowImageId, &rowYear)
+      if scanErr != nil {
+        matches.Close()
+        return errors.New(s("SQLite error\n %s\n", scanErr.Error()))
+      }
+
+      if !similarTitles(rowTitle, candidate.Title) {
+        continue
+      }
+
+      distance := rowStart - candidate.StartTime
+      if distance < 0 {
+        distance = -distance
+      }
+
+      if bestId == 0 || distance < bestDistance {
+        bestId = rowId
+        bestDistance = distance
+        descrId = rowDescrId
+        imageId = rowImageId
+        year = rowYear
+      }
+    }
+
+    matches.Close()
+
+    if bestId == 0 {
+      continue
+    }
+
+    enriched := false
+
+    if candidate.Description.Valid && hasEmpty && descrId == emptyId {
+      newDescrId, descrErr := addDescription(ctx, textInsert, ftsInsert, candidate.Description.String)
+      if descrErr != nil {
+        return descrErr
+      }
+
+      descrId = newDescrId
+      enriched = true
+    }
+
+    if candidate.Image.Valid && !imageId.Valid {
+      uriId, uriErr := addUri(ctx, uriInsert, rewriteImageUrl(candidate.Image.String))
+      if uriErr != nil {
+        return uriErr
+      }
+
+      _, imageErr := imageInsert.Exec(bestId, uriId, nil, nil, nil, nil, nil)
+      if imageErr != nil {
+        return errors.New(s("programme_images INSERT failed\n %s\n", imageErr.Error()))
+      }
+
+      imageId = sql.NullInt64{
+        Int64: uriId,
+        Valid: true,
+      }
+      enriched = true
+    }
+
+    if candidate.Year.Valid && !year.Valid {
+      year = candidate.Year
+      enriched = true
+    }
+
+    if !enriched {
+      continue
+    }
+
+    _, updateErr := updateSql.Exec(descrId, imageId, year, bestId)
+    if updateErr != nil {
+      return errors.New(s("Failed to enrich programme\n %s\n", updateErr.Error()))
+    }
+
+    enrichedSlots[candidate.ChId] += 1
+  }
+
+  return nil
+}
+
+func deleteElement(ctx *RequestContext, programmeId int64, bulkTx *sql.Tx) error {
+  // strings and uris of deleted programme are left in place, they might be shared with others
+  deleteQueries := []string{
+    "DELETE FROM search_meta_0 WHERE _id = ?;",
+    "DELETE FROM eltex_temp_search_tags WHERE _id = ?;",
+    "DELETE FROM credits WHERE programme_id = ?;",
+    "DELETE FROM programme_urls WHERE programme_id = ?;",
+    "DELETE FROM programme_keywords WHERE programme_id = ?;",
+    "DELETE FROM programme_images WHERE programme_id = ?;",
+  }
+
+  if storeTranslations {
+    deleteQueries = append(deleteQueries, "DELETE FROM translations WHERE programme_id = ?;")
+  }
+
+  for _, deleteQuery := range deleteQueries {
+    _, deleteErr := bulkTx.Exec(deleteQuery, programmeId)
+    if deleteErr != nil {
+      return errors.New(s("Failed to delete duplicate programme\n %s\n", deleteErr.Error()))
+    }
+  }
+
+  return nil
+}
+
+func programmeEntries(bulkTx *sql.Tx, table string, key string, programmeId int64) (map[string]struct{}, error) {
+  entries := make(map[string]struct{})
+
+  rows, queryErr := bulkTx.Query(s("SELECT %s FROM %s WHERE programme_id = ?;", key, table), programmeId)
+  if queryErr != nil {
+    return nil, errors.New(s("Failed to query %s table\n %s\n", table, queryErr.Error()))
+  }
+
+  defer rows.Close()
+
+  for rows.Next() {
+    var entry string
+
+    scanErr := rows.Scan(&entry)
+    if scanErr != nil {
+      return nil, errors.New(s("SQLite error\n %s\n", scanErr.Error()))
+    }
+
+    entries[entry] = struct{}{}
+  }
+
+  return entries, nil
+}
+
+func mergeElement(ctx *RequestContext, programme *Programm, programmeId int64, bulkTx *sql.Tx, catsColumn string, descrId int64, metaValues ...interface{}) error {
+  // the first programme keeps it's title and timing, everything it lacks is taken from duplicate
+  args := []interface{}{ ctx.stringMap[""], descrId }
+  args = append(args, metaValues...)
+  args = append(args, programmeId)
+
+  _, mergeErr := bulkTx.Stmt(ctx.sql16).Exec(args...)
+  if mergeErr != nil {
+    return errors.New(s("Meta UPDATE failed\n %s\n", mergeErr.Error()))
+  }
+
+  if catsColumn != "" {
+    // duplicate categories are dropped in finishDb
+    _, tagsErr := bulkTx.Exec("UPDATE eltex_temp_search_tags SET tag_list = tag_list || ? WHERE _id = ?;", catsColumn, programmeId)
+    if tagsErr != nil {
+      return errors.New(s("Tag UPDATE failed\n %s\n", tagsErr.Error()))
+    }
+  }
+
+  // credits and images are merged item by item, the ones already present are skipped;
+  // keys must match the ones, built by addCredits and addImages
+  credits, queryErr := programmeEntries(bulkTx, "credits", "person_id || '|' || credit_type || '|' || IFNULL(role, '')", programmeId)
+  if queryErr != nil {
+    return queryErr
+  }
+
+  creditsErr := addCredits(ctx, &programme.Credits, programmeId, bulkTx, credits)
+  if creditsErr != nil {
+    return creditsErr
+  }
+
+  // urls and keywords are merged item by item, unique indexes drop the ones already present
+  linksErr := addLinks(ctx, programme, programmeId, bulkTx)
+  if linksErr != nil {
+    return linksErr
+  }
+
+  images, queryErr := programmeEntries(bulkTx, "programme_images", "uri_id || '|' || IFNULL(type, '')", programmeId)
+  if queryErr != nil {
+    return queryErr
+  }
+
+  return addImages(ctx, programme, programmeId, bulkTx, images)
+}
+
+func firstImageUri(programme *Programm) string {
+  if (len(programme.Images) != 0 && len(programme.Images[0].Uri) != 0) {
+    //fmt.Printf("image = %s", programme.Images[0].Uri)
+
+    return programme.Images[0].Uri
+  }
+
+  // old STBs know only about image_uri column, give them at least something
+  for _, image := range programme.ExtraImages {
+    if imageUri := strings.TrimSpace(image.Uri); imageUri != "" {
+      return imageUri
+    }
+  }
+
+  return ""
+}
+
+func parseYear(value string) sql.NullInt64 {
+  var progYear sql.NullInt64
+
+  if value != "" {
+    yearMatch := yearRegexp1.FindStringSubmatch(value)
+    if yearMatch != nil {
+      parsedYear, _ := strconv.Atoi(yearMatch[1])
+
+      progYear = sql.NullInt64{
+        Int64: int64(parsedYear),
+        Valid: true,
+      }
+    }
+  }
+
+  return progYear
+}
+
+func parseDimension(value string) sql.NullInt64 {
+  // sizes are sometimes written with units ("120px"), and garbage in them
+  // should not prevent the rest of element from being imported
+  value = strings.TrimSpace(value)
+
+  digits := 0
+  for digits < len(value) && value[digits] >= '0' && value[digits] <= '9' {
+    digits += 1
+  }
+
+  number, numErr := strconv.Atoi(value[:digits])
+  if numErr != nil || number == 0 {
+    return sql.NullInt64{}
+  }
+
+  return sql.NullInt64{
+    Int64: int64(number),
+    Valid: true,
+  }
+}
+
+func rewriteImageUrl(imageUri string) string {
+  if imageBaseUrl == nil {
+    return imageUri
+  }
+
+  parsedUrl, urlErr := url.Parse(imageUri)
+
+  if urlErr == nil && parsedUrl.IsAbs() {
+    parsedUrl.Host = imageBaseUrl.Host
+
+    if imageBaseUrl.Scheme != "" {
+      parsedUrl.Scheme = imageBaseUrl.Scheme
+    }
+
+    if imageBaseUrl.Path != "" && imageBaseUrl.Path != "/" {
+      parsedUrl.Path = imageBaseUrl.Path + parsedUrl.Path
+    }
+
+    return parsedUrl.String()
   }
 
-  if *fakeEnd != "" {
-    emptyStrId := ctx.stringMap[*fakeEnd]
+  return imageUri
+}
 
-    if emptyStrId == 0 {
-      r, _ := bulkTx.Exec("INSERT INTO text (text) VALUES (?);", *fakeEnd)
-      emptyStrId, _ = r.LastInsertId()
+func addImages(ctx *RequestContext, programme *Programm, programmeId int64, bulkTx *sql.Tx, existing map[string]struct{}) error {
+  uriInsert := bulkTx.Stmt(ctx.sql3)
+  imageInsert := bulkTx.Stmt(ctx.sql14)
+
+  nullableText := func(value string) sql.NullString {
+    return sql.NullString{
+      String: value,
+      Valid: value != "",
     }
+  }
 
-    fakeInsert, _ := bulkTx.Prepare(fmt.Sprintf("INSERT INTO search_meta_0 (start_time, ch_id, title_id, description_id, tags) VALUES (?, ?, %d, %d, 0);", emptyStrId, emptyStrId))
+  // when merging, images of the first programme are not added again
+  isPresent := func(uriId int64, imageType string) bool {
+    if existing == nil {
+      return false
+    }
 
-    for chI, chEnd := range ctx.endMap {
-      endDate, endDateErr := parseXmltvDate(chEnd.EndTime)
-      if endDateErr != nil {
-        continue
-      }
+    key := s("%d|%s", uriId, imageType)
 
-      fakeInsert.Exec(endDate.Unix(), chI)
+    if _, found := existing[key]; found {
+      return true
     }
-  }
 
-  tagList := make([]string, 0, len(tagMap))
+    existing[key] = struct{}{}
 
-  for tag, _ := range tagMap {
-    tagList = append(tagList, tag)
+    return false
   }
 
-  sort.Slice(tagList, func(i, j int) bool {
-    left := tagMap[tagList[i]].NumberOfUses
-    right := tagMap[tagList[j]].NumberOfUses
-
-    if left > right {
-      return true
-    } else if left < right {
-      return false
+  // <icon> has no type, it is stored with NULL in type column
+  for _, icon := range programme.Images {
+    if icon.Uri == "" {
+      continue
     }
 
-    return tagList[i] < tagList[j]
-  })
+    uriId, uriErr := addUri(ctx, uriInsert, rewriteImageUrl(icon.Uri))
+    if uriErr != nil {
+      return uriErr
+    }
 
-  for pos, tag := range tagList {
-    // sqlite supports only signed values, so we are limited to 63 bits
-    if pos > 62 {
-      break
+    if isPresent(uriId, "") {
+      continue
     }
 
-    idVal := 1 << pos
+    _, imageErr := imageInsert.Exec(programmeId, uriId, nil, nil, nil, parseDimension(icon.Width), parseDimension(icon.Height))
+    if imageErr != nil {
+      return errors.New(s("programme_images INSERT failed\n %s\n", imageErr.Error()))
+    }
+  }
 
-    //fmt.Printf("Adding new tag '%s' (value is %d, number of uses is %d)\n", tag, idVal, tagMap[tag].NumberOfUses)
+  for _, image := range programme.ExtraImages {
+    imageUri := strings.TrimSpace(image.Uri)
+    if imageUri == "" {
+      continue
+    }
 
-    _, tInsertErr := bulkTx.Stmt(ctx.sql6).Exec(idVal, tag)
-    if tInsertErr != nil {
-      return errors.New(s("Failed to insert into tags table: %s\n", tInsertErr.Error()))
+    uriId, uriErr := addUri(ctx, uriInsert, rewriteImageUrl(imageUri))
+    if uriErr != nil {
+      return uriErr
     }
 
-    tagMap[tag].IdVal = int64(idVal)
-  }
+    if isPresent(uriId, strings.ToLower(image.Type)) {
+      continue
+    }
 
-  bulkTxError := bulkTx.Commit()
-  if bulkTxError != nil {
-    return errors.New(s("Failed to commit final pass transaction\n %s\n", bulkTxError.Error()))
+    _, imageErr := imageInsert.Exec(programmeId, uriId, nullableText(strings.ToLower(image.Type)), nullableText(strings.ToUpper(image.Orient)), parseDimension(image.Size), nil, nil)
+    if imageErr != nil {
+      return errors.New(s("programme_images INSERT failed\n %s\n", imageErr.Error()))
+    }
   }
 
-  fmt.Printf("Inserted %d channels (%d archived), %d programm entries, %d unique strings\n", ctx.appendedChannels, archivedChannels, ctx.appendedElements, ctx.textIdMax)
+  return nil
+}
 
-  if (len(tagMap) > 63) {
-    fmt.Printf("Original XMLTV file has %d tags, the most popular 63 will be added to EPGX\n", len(tagMap))
+func addUri(ctx *RequestContext, uriInsert *sql.Stmt, uri string) (int64, error) {
+  uriId := ctx.uriMap[uri]
+  if uriId != 0 {
+    return uriId, nil
   }
 
-  if mappedTotal == 0 && len(idMap) != 0 {
-    fmt.Printf("WARNING: none of %d mappings were used!\n", len(idMap))
-  }
+  uriId = ctx.uriIdMax
+  ctx.uriIdMax += 1
 
-  if archivedChannels == 0 && dvrLength == 0 {
-    fmt.Printf("WARNING: none of channels have archive!\n")
-  }
+  ctx.uriMap[uri] = uriId
 
-  if (snippetLength >= 0) {
-     fmt.Printf("Trimmed %d characters. Max length before trimming: %d\n", trimmedTotal, snippetLengthMax)
+  _, uriErr := uriInsert.Exec(uriId, uri)
+  if (uriErr != nil) {
+    return 0, errors.New(s("URI INSERT failed\n %s\n", uriErr.Error()))
   }
 
-  rows, queryErr := db.Query("SELECT _id, tag_list FROM eltex_temp_search_tags")
-  if queryErr != nil {
-    return errors.New(s("Failed to request EPG rows from database\n %s\n", queryErr.Error()))
-  }
+  return uriId, nil
+}
 
-  dbIds := make([]int64, 0)
-  dbCats := make([]int64, 0)
+func addDescription(ctx *RequestContext, textInsert *sql.Stmt, ftsInsert *sql.Stmt, description string) (int64, error) {
+  trimmed := 0
 
-  for rows.Next() {
-    var rowId int64
-    var rowCats string
+  progDescription := description
+  if (snippetLength >= 0) {
+    descrSymbols := []rune(progDescription)
 
-    scanErr := rows.Scan(&rowId, &rowCats)
-    if scanErr != nil {
-      return errors.New(s("SQLite error\n %s\n", scanErr.Error()))
-    }
+    if snippetLength < len(descrSymbols) {
+      trimmed = len(descrSymbols) - snippetLength
 
-    dbIds = append(dbIds, rowId)
+      progDescription = string(descrSymbols[:snippetLength])
+    }
+  }
 
-    var catVal int64
+  descrId := ctx.stringMap[progDescription]
+  if descrId == 0 {
+    runeLength := utf8.RuneCountInString(description)
 
-    catVal = 0
+    if runeLength > snippetLengthMax {
+      snippetLengthMax = runeLength
+    }
 
-    for _, catName := range strings.Split(rowCats, ",") {
-      if catName == "" {
-        continue
-      }
+    descrId = ctx.textIdMax
+    ctx.textIdMax += 1
 
-      catIdx := tagMap[catName].IdVal
+    ctx.stringMap[progDescription] = descrId
 
-      if catIdx == 0 {
-        continue
-      }
+    _, ftsDescrTextErr := textInsert.Exec(descrId, progDescription)
+    if (ftsDescrTextErr != nil) {
+      return 0, errors.New(s("text INSERT failed\n %s\n", ftsDescrTextErr.Error()))
+    }
 
-      catVal |= catIdx
+    _, ftsErr := ftsInsert.Exec(descrId, ftsText(progDescription))
+    if (ftsErr != nil) {
+      return 0, errors.New(s("FTS INSERT failed\n %s\n", ftsErr.Error()))
     }
 
-    dbCats = append(dbCats, catVal)
+    trimmedTotal += trimmed
   }
 
-  rows.Close()
+  return descrId, nil
+}
 
-  caTx, caTxErr := db.Begin()
-  if caTxErr != nil {
-    return errors.New(s("Could not start transaction\n %s\n", caTxErr.Error()))
+func addText(ctx *RequestContext, textInsert *sql.Stmt, ftsInsert *sql.Stmt, text string) (int64, error) {
+  textId := ctx.stringMap[text]
+  if textId != 0 {
+    return textId, nil
   }
 
-  updateSql, prepErr := caTx.Prepare("UPDATE search_meta_0 SET tags = ? WHERE _id = ?;")
-  if prepErr != nil {
-    return errors.New(s("Prepare() failed: %s\n", err.Error()))
-  }
+  textId = ctx.textIdMax
+  ctx.textIdMax += 1
 
-  for pos, itemId := range dbIds {
-    itemCatVal := dbCats[pos]
+  ctx.stringMap[text] = textId
 
-    updateSql.Exec(itemCatVal, itemId)
+  _, textErr := textInsert.Exec(textId, text)
+  if (textErr != nil) {
+    return 0, errors.New(s("text INSERT failed\n %s\n", textErr.Error()))
   }
 
-  _, err = caTx.Exec("DROP TABLE eltex_temp_search_tags")
-  if err != nil {
-    return errors.New(s("Failed to delete aux table: %s\n", err.Error()))
+  _, ftsErr := ftsInsert.Exec(textId, ftsText(text))
+  if (ftsErr != nil) {
+    return 0, errors.New(s("FTS INSERT failed\n %s\n", ftsErr.Error()))
   }
 
-  _, err = caTx.Exec("DROP INDEX unique_start_time")
-  if err != nil {
-    Bail("Failed to drop aux index: %s\n", err.Error())
+  return textId, nil
+}
+
+func langMatches(lang string, pref string) bool {
+  // "ru" matches "ru", "RU" and "ru-RU"
+  lang = strings.ToLower(lang)
+
+  return lang == pref || strings.HasPrefix(lang, pref + "-") || strings.HasPrefix(lang, pref + "_")
+}
+
+func pickLang(texts []LangText) int {
+  for _, pref := range langPrefs {
+    for pos, text := range texts {
+      if langMatches(text.Lang, pref) && text.Text != "" {
+        return pos
+      }
+    }
   }
 
-  _, err = caTx.Exec("CREATE TABLE search_meta (_id INTEGER PRIMARY KEY, ch_id NOT NULL, start_time INTEGER NOT NULL, title_id INTEGER NOT NULL, description_id INTEGER NOT NULL, " + addOptionalCols() + "image_uri INTEGER);")
-  if err != nil {
-    Bail("Failed to create dest table: %s\n", err.Error())
+  // according to XMLTV DTD, the first one is the default
+  for pos, text := range texts {
+    if text.Text != "" {
+      return pos
+    }
   }
 
-  var copyBuilder strings.Builder
+  return -1
+}
 
-  copyBuilder.WriteString("INSERT INTO search_meta SELECT _id, ch_id, start_time, title_id, description_id")
-  if (!excludeTags) {
-    copyBuilder.WriteString(", tags")
+func langText(texts []LangText, pos int) string {
+  if pos < 0 {
+    return ""
   }
-  if (!excludeYear) {
-    copyBuilder.WriteString(", year")
+
+  return texts[pos].Text
+}
+
+func lengthSeconds(length *Length) sql.NullInt64 {
+  value, valueErr := strconv.Atoi(strings.TrimSpace(length.Value))
+  if valueErr != nil || value <= 0 {
+    return sql.NullInt64{}
   }
-  copyBuilder.WriteString(", image_uri FROM search_meta_0")
 
-  _, err = caTx.Exec(copyBuilder.String())
-  if err != nil {
-    Bail("Failed to copy search_meta: %s\n", err.Error())
+  multiplier := 1
+
+  switch length.Units {
+    case "minutes":
+      multiplier = 60
+    case "hours":
+      multiplier = 3600
   }
 
-  _, err = caTx.Exec("DROP TABLE search_meta_0")
-  if err != nil {
-    Bail("Failed to drop scratch table: %s\n", err.Error())
+  return sql.NullInt64{
+    Int64: int64(value * multiplier),
+    Valid: true,
   }
+}
 
-  if (excludeTags) {
-    _, err = caTx.Exec("DROP TABLE tags")
-    if err != nil {
-      Bail("Failed to drop tags table: %s\n", err.Error())
+func addLinks(ctx *RequestContext, programme *Programm, programmeId int64, bulkTx *sql.Tx) error {
+  uriInsert := bulkTx.Stmt(ctx.sql3)
+  textInsert := bulkTx.Stmt(ctx.sql4)
+  ftsInsert := bulkTx.Stmt(ctx.sql2)
+  urlInsert := bulkTx.Stmt(ctx.sql12)
+  keywordInsert := bulkTx.Stmt(ctx.sql13)
+
+  for _, programmeUrl := range programme.Urls {
+    uri := strings.TrimSpace(programmeUrl.Uri)
+    if uri == "" {
+      continue
+    }
+
+    uriId, uriErr := addUri(ctx, uriInsert, uri)
+    if uriErr != nil {
+      return uriErr
+    }
+
+    var urlSystem sql.NullString
+
+    if programmeUrl.System != "" {
+      urlSystem = sql.NullString{
+        String: programmeUrl.System,
+        Valid: true,
+      }
+    }
+
+    _, urlErr := urlInsert.Exec(programmeId, uriId, urlSystem)
+    if urlErr != nil {
+      return errors.New(s("programme_urls INSERT failed\n %s\n", urlErr.Error()))
     }
   }
 
-  caTxCommitErr := caTx.Commit()
-  if caTxCommitErr != nil {
-    return errors.New(s("Failed to commit tags transaction\n %s\n", caTxCommitErr.Error()))
+  // keywords go to text table, so they can be found with fts_search
+  for _, keyword := range programme.Keywords {
+    keyword = strings.TrimSpace(keyword)
+    if keyword == "" {
+      continue
+    }
+
+    keywordId, keywordErr := addText(ctx, textInsert, ftsInsert, keyword)
+    if keywordErr != nil {
+      return keywordErr
+    }
+
+    _, insertErr := keywordInsert.Exec(programmeId, keywordId)
+    if insertErr != nil {
+      return errors.New(s("programme_keywords INSERT failed\n %s\n", insertErr.Error()))
+    }
   }
 
   return nil
 }
 
-func optimizeDatabase(ctx *RequestContext, dbNam string) error {
-  db := ctx.db
+func addTranslations(ctx *RequestContext, programme *Programm, programmeId int64, bulkTx *sql.Tx) error {
+  textInsert := bulkTx.Stmt(ctx.sql4)
+  ftsInsert := bulkTx.Stmt(ctx.sql2)
+  translationInsert := bulkTx.Stmt(ctx.sql9)
 
-  _, timeIdxErr := db.Exec(s("CREATE INDEX %s.time_idx ON search_meta (start_time);", dbNam))
-  if timeIdxErr != nil {
-    return errors.New(s("index creation failed\n %s\n", timeIdxErr.Error()))
-  }
+  langs := make([]string, 0)
+  texts := make(map[string]*[3]string)
 
-  _, indexErr := db.Exec(s("CREATE INDEX %s.ch_idx ON search_meta (ch_id, start_time);", dbNam))
-  if indexErr != nil {
-    return errors.New(s("index creation failed\n %s\n", indexErr.Error()))
-  }
+  collect := func(langTexts []LangText, pos int) {
+    chosen := pickLang(langTexts)
 
-  _, indexErr2 := db.Exec(s("CREATE INDEX %s.description_idx ON search_meta (description_id);", dbNam))
-  if indexErr2 != nil {
-    return errors.New(s("index creation failed\n %s\n", indexErr2.Error()))
-  }
+    for textPos, text := range langTexts {
+      lang := strings.ToLower(text.Lang)
 
-  _, indexErr3 := db.Exec(s("CREATE INDEX %s.title_idx ON search_meta (title_id);", dbNam))
-  if indexErr3 != nil {
-    return errors.New(s("index creation failed\n %s\n", indexErr3.Error()))
-  }
+      if lang == "" || text.Text == "" || textPos == chosen {
+        continue
+      }
 
-  if !excludeTags {
-    _, indexErr4 := db.Exec(s("CREATE INDEX %s.idx_tags ON search_meta(tags);", dbNam))
-    if indexErr4 != nil {
-      return errors.New(s("index creation failed\n %s\n", indexErr4.Error()))
+      if texts[lang] == nil {
+        texts[lang] = &[3]string{}
+        langs = append(langs, lang)
+      }
+
+      texts[lang][pos] = text.Text
     }
   }
 
-  _, optimizeErr := db.Exec(s("INSERT INTO %s.fts_search(fts_search) VALUES('optimize');", dbNam))
-  if optimizeErr != nil {
-    return errors.New(s("optimize() failed\n %s\n", optimizeErr.Error()))
-  }
+  collect(programme.Titles, 0)
+  collect(programme.SubTitles, 1)
+  collect(programme.Descriptions, 2)
 
-  _, analyzeErr := db.Exec("ANALYZE;")
-  if analyzeErr != nil {
-    return errors.New(s("ANALYZE failed\n %s\n", analyzeErr.Error()))
-  }
+  for _, lang := range langs {
+    var ids [3]sql.NullInt64
 
-  _, vacuumErr := db.Exec("VACUUM;")
-  if vacuumErr != nil {
-    return errors.New(s("VACUUM failed\n %s\n", vacuumErr.Error()))
+    for pos, text := range texts[lang] {
+      if text == "" {
+        continue
+      }
+
+      if pos == 0 {
+        if pureText := ageRegexp.FindStringSubmatch(text); pureText != nil && pureText[1] != "" {
+          text = pureText[1]
+        }
+      }
+
+      if pos == 2 && snippetLength >= 0 {
+        descrSymbols := []rune(text)
+
+        if snippetLength < len(descrSymbols) {
+          text = string(descrSymbols[:snippetLength])
+        }
+      }
+
+      textId, textErr := addText(ctx, textInsert, ftsInsert, text)
+      if textErr != nil {
+        return textErr
+      }
+
+      ids[pos] = sql.NullInt64{
+        Int64: textId,
+        Valid: true,
+      }
+    }
+
+    _, insertErr := translationInsert.Exec(programmeId, lang, ids[0], ids[1], ids[2])
+    if insertErr != nil {
+      return errors.New(s("translations INSERT failed\n %s\n", insertErr.Error()))
+    }
   }
 
   return nil
 }
 
-func parseXmltvDate(source string) (time.Time, error) {
-  // XMLTV dates are "loosely based on ISO 8601", which is rather poorly supported by Go
-  // so we have to do a bit of extra fiddling ourselves
-
-  timeMatch := timeRegexp1.FindStringSubmatch(source)
-  if timeMatch == nil {
-    return time.Time{}, errors.New(s("Failed to parse date: %s\n", source))
-  }
+func programmeFlags(programme *Programm) int64 {
+  var flags int64
 
-  if xmltvTzOverride != nil {
-    return time.ParseInLocation("20060102150405", timeMatch[1], xmltvTzOverride)
-  } else if len(timeMatch) > 2 {
-    return time.ParseInLocation("20060102150405 -0700", source, localLocation)
-  } else {
-    return time.ParseInLocation("20060102150405", timeMatch[1], localLocation)
+  if programme.Premiere != nil {
+    flags |= FlagPremiere
   }
-}
 
-func isReadyForFts(c rune) (bool) {
-  // from https://www.sqlite.org/fts3.html
-  //
-  // A term is a contiguous sequence of eligible characters, where eligible characters are
-  // all alphanumeric characters and all characters with Unicode codepoint values greater
-  // than or equal to 128. All other characters are discarded
+  if programme.New != nil {
+    flags |= FlagNew
+  }
 
-  if (c >= 'a' && c <= 'z') {
-    return true;
+  if programme.Live != nil {
+    flags |= FlagLive
   }
 
-  if (c >= '0' && c <= '9') {
-    return true;
+  if programme.PreviouslyShown != nil {
+    flags |= FlagPreviouslyShown
   }
 
-  return c >= 128;
+  if programme.LastChance != nil {
+    flags |= FlagLastChance
+  }
+
+  // radio programmes in TV guides; absence of audio is stored in audio column
+  if strings.ToLower(strings.TrimSpace(programme.Video.Present)) == "no" {
+    flags |= FlagNoVideo
+  }
+
+  return flags
 }
 
-func preprocess(name string) (string) {
-  // replace punctuation and special characters with spaces
-  // and trim all resulting excess space from string
+func isAsciiLetters(value string) bool {
+  for _, c := range value {
+    if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') {
+      return false
+    }
+  }
 
-  var builder strings.Builder
+  return true
+}
 
-  lastIsSpace := false
+func normalizeCountries(rawCountry string) []string {
+  // one <country> may contain several countries ("США, Франция")
+  codes := make([]string, 0, 1)
 
-  for _, c := range name {
-    if (c >= 'A' && c <= 'Z') {
-      c = c + ('a' - 'A');
-    } else if (c >= 'А' && c <= 'Я') {
-      // not necessary for FTS, just normalization for caller
-      c = c + ('я' - 'Я');
-    } else if (!isReadyForFts(c)) {
-      c = ' ';
-    }
+  nestedCountries := strings.FieldsFunc(rawCountry, func(c rune) bool {
+    return c == ',' || c == ';' || c == '/'
+  })
 
-    if c == ' ' && lastIsSpace {
+  for _, country := range nestedCountries {
+    country = strings.TrimSpace(country)
+
+    if country == "" {
       continue
     }
 
-    lastIsSpace = c == ' '
-
-    builder.WriteRune(c);
+    if code, ok := countryCodes[strings.ToLower(country)]; ok {
+      codes = append(codes, code)
+    } else if len(country) == 2 && isAsciiLetters(country) {
+      codes = append(codes, strings.ToUpper(country))
+    } else {
+      unknownCountries[country] += 1
+    }
   }
 
-  return strings.TrimSpace(builder.String())
+  return codes
 }
 
-func addChannel(ctx *RequestContext, decoder *xml.Decoder, channel *Channel, xmlElement *xml.StartElement, bulkTx *sql.Tx) (bool, error) {
-  decErr := decoder.DecodeElement(channel, xmlElement)
-  if (decErr != nil) {
-    return false, errors.New(s("Could not decode element\n %s\n", decErr.Error()))
+func normalizeLanguage(rawLanguage string) string {
+  language := strings.TrimSpace(rawLanguage)
+
+  if language == "" {
+    return ""
   }
 
-  var imageUri sql.NullString
+  if code, ok := languageCodes[strings.ToLower(language)]; ok {
+    return code
+  }
 
-  if channel.Icon.Uri != "" {
-    imageUri = sql.NullString{
-      String: channel.Icon.Uri,
-      Valid: true,
-    }
+  // "ru", "RU", "ru-RU", "ru_RU"
+  if len(language) >= 2 && isAsciiLetters(language[:2]) && (len(language) == 2 || language[2] == '-' || language[2] == '_') {
+    return strings.ToLower(language[:2])
   }
 
-  if (channel.Name == "" || channel.Id == "") {
-    return false, nil
+  unknownLanguages[language] += 1
+
+  return ""
+}
+
+func reportUnknown(what string, outcome string, unknown map[string]int) {
+  if len(unknown) == 0 {
+    return
   }
 
-  chId := channel.Id
-  archived := 0
+  names := make([]string, 0, len(unknown))
 
-  var channelPage sql.NullString
+  for name, _ := range unknown {
+    names = append(names, name)
+  }
 
-  if mappedId, ok := idMap[chId]; ok {
-    chId = mappedId.Id
-    archived = mappedId.ArchiveHours
+  sort.Slice(names, func(i, j int) bool {
+    return unknown[names[i]] > unknown[names[j]] || unknown[names[i]] == unknown[names[j]] && names[i] < names[j]
+  })
 
-    if mappedId.ImageUrlOverride != "" {
-      imageUri = sql.NullString{
-        String: mappedId.ImageUrlOverride,
-        Valid: true,
-      }
+  var b strings.Builder
+
+  for pos, name := range names {
+    if pos == 10 {
+      b.WriteString(s(" and %d more", len(names) - pos))
+      break
     }
 
-    if mappedId.ChannelPage != "" {
-      channelPage = sql.NullString{
-        String: mappedId.ChannelPage,
-        Valid: true,
-      }
+    if pos != 0 {
+      b.WriteString(", ")
     }
-  }
 
-  if archived == 0 {
-    archived = dvrLength
+    b.WriteString(s("'%s' (%d)", name, unknown[name]))
   }
 
-  if len(channelWhitelist) != 0 {
-    if _, ok := channelWhitelist[chId]; !ok {
-      return false, nil
-    }
-  }
+  fmt.Printf("WARNING: %d unknown %s %s: %s\n", len(names), what, outcome, b.String())
+}
 
-  if _, blacklisted := channelBlacklist[chId]; blacklisted {
-    return false, nil
+func reportChannels(warning bool, what string, perChannel map[string]int) {
+  if len(perChannel) == 0 {
+    return
   }
 
-  if archived > 0 {
-    archivedChannels += 1
+  channels := make([]string, 0, len(perChannel))
+  total := 0
 
-    // store archived time in seconds
-    archived *= 3600;
+  for chId, count := range perChannel {
+    channels = append(channels, chId)
+    total += count
   }
 
-  //fmt.Printf("Inserting %s, %s %s %d\n", chId, imageUri.String, channel.Name, archived)
+  sort.Strings(channels)
 
-  chInsertRes, chInsertErr := bulkTx.Stmt(ctx.sql5).Exec(chId, imageUri, preprocess(channel.Name), archived, channelPage)
-  if chInsertErr != nil {
-    return false, errors.New(s("Failed to insert into channels table\n", chInsertErr.Error()))
+  if warning {
+    fmt.Printf("WARNING: ")
   }
 
-  rowsAffected, _ := chInsertRes.RowsAffected()
+  fmt.Printf("%d %s:\n", total, what)
 
-  return rowsAffected != 0, nil;
+  for _, chId := range channels {
+    fmt.Printf("  %s: %d\n", chId, perChannel[chId])
+  }
 }
 
-func addElement(ctx *RequestContext, decoder *xml.Decoder, programme *Programm, xmlElement *xml.StartElement, bulkTx *sql.Tx) (bool, error) {
-  decErr := decoder.DecodeElement(programme, xmlElement)
-  if (decErr != nil) {
-    return false, errors.New(s("Could not decode element\n %s\n", decErr.Error()))
+func yesNo(value string) sql.NullInt64 {
+  switch strings.ToLower(strings.TrimSpace(value)) {
+    case "yes":
+      return sql.NullInt64{ Int64: 1, Valid: true }
+    case "no":
+      return sql.NullInt64{ Int64: 0, Valid: true }
   }
 
-  var chOffset int64 = 0
-
-  chId := programme.Channel
+  return sql.NullInt64{}
+}
 
-  if mappedId, ok := idMap[chId]; ok {
-    chId = mappedId.Id
-    chOffset = int64(mappedId.TimeOffsetHours)
+func videoQuality(quality string) sql.NullInt64 {
+  quality = strings.ToUpper(strings.TrimSpace(quality))
 
-    mappedTotal += 1
+  if quality == "" {
+    return sql.NullInt64{}
   }
 
-  if len(channelWhitelist) != 0 {
-    if _, ok := channelWhitelist[chId]; !ok {
-      return false, nil
-    }
+  switch {
+    case strings.Contains(quality, "UHD") || strings.Contains(quality, "4K") || strings.Contains(quality, "2160") || strings.Contains(quality, "8K"):
+      return sql.NullInt64{ Int64: QualityUHD, Valid: true }
+    case strings.Contains(quality, "HD") || strings.Contains(quality, "720") || strings.Contains(quality, "1080"):
+      return sql.NullInt64{ Int64: QualityHD, Valid: true }
   }
 
-  if _, blacklisted := channelBlacklist[chId]; blacklisted {
-    return false, nil
+  return sql.NullInt64{ Int64: QualitySD, Valid: true }
+}
+
+func audioKind(audio *Audio) sql.NullInt64 {
+  if strings.ToLower(strings.TrimSpace(audio.Present)) == "no" {
+    return sql.NullInt64{ Int64: AudioNone, Valid: true }
   }
 
-  startTime, timeErr := parseXmltvDate(programme.Start)
-  if (timeErr != nil) {
-    return false, errors.New(s("Failed to parse start time\n %s\n", timeErr.Error()))
+  switch strings.ToLower(strings.TrimSpace(audio.Stereo)) {
+    case "mono":
+      return sql.NullInt64{ Int64: AudioMono, Valid: true }
+    case "stereo":
+      return sql.NullInt64{ Int64: AudioStereo, Valid: true }
+    case "dolby":
+      return sql.NullInt64{ Int64: AudioDolby, Valid: true }
+    case "dolby digital":
+      return sql.NullInt64{ Int64: AudioDolbyDigital, Valid: true }
+    case "bilingual":
+      return sql.NullInt64{ Int64: AudioBilingual, Valid: true }
+    case "surround":
+      return sql.NullInt64{ Int64: AudioSurround, Valid: true }
   }
 
-  startTime = time.Unix((int64) (startTime.Unix() + chOffset * 3600), 0).In(localLocation)
+  return sql.NullInt64{}
+}
 
-  if (startTime.Before(startFrom)) {
-    if (dbLastDate == nil || startTime.After(*dbLastDate)) {
-      dbLastDate = &startTime
-    }
-    return false, nil
-  }
+func subtitleKinds(subtitles []Subtitles) int64 {
+  var kinds int64
 
-  if (startFrom.Add(spanDuration).Before(startTime)) {
-    if (dbEarliestDate == nil || startTime.Before(*dbEarliestDate)) {
-      dbEarliestDate = &startTime
+  for _, subtitle := range subtitles {
+    switch strings.ToLower(subtitle.Type) {
+      case "teletext":
+        kinds |= SubtitlesTeletext
+      case "deaf-signed":
+        kinds |= SubtitlesDeafSigned
+      default:
+        // type is optional, subtitles without it are burned into picture
+        kinds |= SubtitlesOnscreen
     }
-    return false, nil
   }
 
-  epgBounds := ctx.limits[chId]
-  if epgBounds[0] != 0 {
-    epgStart := epgBounds[0]
-    epgEnd := epgBounds[1]
+  return kinds
+}
 
-    if startTime.Unix() >= epgStart && startTime.Unix() <= epgEnd {
-      // this entry is within period, already seen in previous XMLTV file
-      return false, nil
-    }
+func nullableInt(value int) sql.NullInt64 {
+  return sql.NullInt64{
+    Int64: int64(value),
+    Valid: value != 0,
   }
+}
 
-  lastEnd := ctx.endMap[chId]
-
-  if lastEnd == nil || lastEnd.StartTime < startTime.Unix() {
-    ctx.endMap[chId] = &EndMeta{
-      StartTime: startTime.Unix(),
-      EndTime: programme.End,
-    }
+func nullableNumber(value int) sql.NullInt64 {
+  // for numbers, where 0 is a valid value, and -1 stands for unknown
+  return sql.NullInt64{
+    Int64: int64(value),
+    Valid: value >= 0,
   }
+}
 
-  firstStart := ctx.bgnMap[chId]
+func parseEpisodeNums(programme *Programm) {
+  // several systems may be present at once, xmltv_ns is the most precise one,
+  // so it is applied last and overrides the numbers it has
 
-  if firstStart == nil || firstStart.StartTime > startTime.Unix() {
-    ctx.bgnMap[chId] = &EndMeta{
-      StartTime: startTime.Unix(),
-      EndTime: programme.End,
+  programme.Season, programme.Episode, programme.Part = -1, -1, -1
+
+  sort.SliceStable(programme.EpisodeNums, func(i, j int) bool {
+    return programme.EpisodeNums[i].System != "xmltv_ns" && programme.EpisodeNums[j].System == "xmltv_ns"
+  })
+
+  for _, episodeNum := range programme.EpisodeNums {
+    value := strings.TrimSpace(episodeNum.Value)
+    if value == "" {
+      continue
     }
-  }
 
-  progTitle := programme.Title
-  if (progTitle != "" && !strings.HasSuffix(progTitle, "(18+)")) {
-    // a lot of slots has extraneous suffixes like '(6+)'
-    // we don't care about those, except for the adult-rated stuff, so let's remove them
-    pureText := ageRegexp.FindStringSubmatch(progTitle)
-    if (len(pureText) > 1) {
-      progTitle = strings.TrimSpace(pureText[1])
+    var parsed bool
+
+    switch episodeNum.System {
+      case "xmltv_ns":
+        parsed = parseXmltvNs(programme, value)
+      case "onscreen", "SxxExx":
+        parsed = parseOnscreen(programme, value)
+      default:
+        // unknown numbering system or database ID (e.g. dd_progid, whose suffix
+        // identifies the episode, but isn't its number), nothing to report
+        continue
     }
-  }
 
-  if compiledTemplate != nil {
-    var buff bytes.Buffer
+    if !parsed {
+      badEpisodeNums += 1
 
-    tmplErr := compiledTemplate.Execute(&buff, programme)
-    if tmplErr == nil {
-      progTitle = buff.String()
+      if badEpisodeNums <= 10 {
+        fmt.Fprintf(os.Stderr, "Failed to parse <episode-num system=\"%s\">%s</episode-num> of '%s'\n", episodeNum.System, value, programme.Title)
+      }
     }
   }
+}
 
-  trimmed := 0
+func parseAgeRating(programme *Programm) {
+  // a lot of slots has suffixes like '(6+)' in title, we move those to
+  // age_rating column; titles in other languages and <rating> elements
+  // are taken into account too, and the strictest of all ratings wins
 
-  progDescription := programme.Description
-  if (snippetLength >= 0) {
-    descrSymbols := []rune(progDescription)
+  programme.AgeRating = -1
 
-    if snippetLength < len(descrSymbols) {
-      trimmed = len(descrSymbols) - snippetLength
+  pureText := ageRegexp.FindStringSubmatch(programme.Title)
+  if pureText != nil && pureText[1] != "" {
+    programme.Title = pureText[1]
+  }
 
-      progDescription = string(descrSymbols[:snippetLength])
+  // suffixes of translations are stripped by addTranslations, so they are read here
+  for _, title := range programme.Titles {
+    titleMatch := ageRegexp.FindStringSubmatch(title.Text)
+    if titleMatch == nil || titleMatch[1] == "" {
+      continue
     }
-  }
 
-  textInsert := bulkTx.Stmt(ctx.sql4)
-  ftsInsert := bulkTx.Stmt(ctx.sql2)
-  uriInsert := bulkTx.Stmt(ctx.sql3)
-  metaInsert := bulkTx.Stmt(ctx.sql1)
-  tagInsert := bulkTx.Stmt(ctx.sql7)
+    age, _ := strconv.Atoi(titleMatch[2])
 
-  titleId := ctx.stringMap[progTitle]
-  if titleId == 0 {
-    titleId = ctx.textIdMax
-    ctx.textIdMax += 1
+    if age > programme.AgeRating {
+      programme.AgeRating = age
+    }
+  }
 
-    ctx.stringMap[progTitle] = titleId
+  for _, rating := range programme.Ratings {
+    age := ratingToAge(strings.TrimSpace(rating.Value))
 
-    _, ftsTitleTextErr := textInsert.Exec(titleId, progTitle)
-    if (ftsTitleTextErr != nil) {
-      return false, errors.New(s("text INSERT failed\n %s\n", ftsTitleTextErr.Error()))
+    if age > programme.AgeRating {
+      programme.AgeRating = age
     }
+  }
+}
 
-    if useLegacyFormat {
-      progTitle = strings.ToLower(progTitle)
-      progTitle = strings.ReplaceAll(progTitle, "ё", "е")
-    }
+func ratingToAge(value string) int {
+  // MPAA and US TV Parental Guidelines don't have numbers in all values
+  switch strings.ToUpper(value) {
+    case "G", "TV-Y", "TV-G", "E", "U", "0":
+      return 0
+    case "PG", "TV-Y7", "TV-Y7-FV":
+      return 7
+    case "TV-PG":
+      return 10
+    case "PG-13":
+      return 13
+    case "TV-14":
+      return 14
+    case "R", "TV-MA":
+      return 17
+    case "NC-17", "X", "XXX":
+      return 18
+  }
+
+  ratingMatch := ratingRegexp1.FindStringSubmatch(value)
+  if ratingMatch == nil {
+    return -1
+  }
+
+  age, _ := strconv.Atoi(ratingMatch[1])
+
+  return age
+}
 
-    _, ftsTitleErr := ftsInsert.Exec(titleId, progTitle)
-    if (ftsTitleErr != nil) {
-      return false, errors.New(s("FTS INSERT failed\n %s\n", ftsTitleErr.Error()))
-    }
+func parseXmltvNs(programme *Programm, value string) bool {
+  // "season[/total].episode[/total].part[/total]", all numbers are zero-based,
+  // any component may be omitted (e.g. ".5." or "1.."), some providers also skip the part
+
+  components := strings.Split(strings.ReplaceAll(value, " ", ""), ".")
+  if len(components) < 2 || len(components) > 3 {
+    return false
   }
 
-  descrId := ctx.stringMap[progDescription]
-  if descrId == 0 {
-    runeLength := utf8.RuneCountInString(programme.Description)
+  // -1 for numbers and 0 for totals are placeholders of omitted components
+  numbers := [3][2]int{ { -1, 0 }, { -1, 0 }, { -1, 0 } }
 
-    if runeLength > snippetLengthMax {
-      snippetLengthMax = runeLength
+  for pos, component := range components {
+    if component == "" {
+      continue
     }
 
-    descrId = ctx.textIdMax
-    ctx.textIdMax += 1
+    numAndTotal := strings.SplitN(component, "/", 2)
 
-    ctx.stringMap[progDescription] = descrId
+    if numAndTotal[0] != "" {
+      num, numErr := strconv.Atoi(numAndTotal[0])
+      if numErr != nil || num < 0 {
+        return false
+      }
 
-    _, ftsDescrTextErr := textInsert.Exec(descrId, progDescription)
-    if (ftsDescrTextErr != nil) {
-      return false, errors.New(s("text INSERT failed\n %s\n", ftsDescrTextErr.Error()))
+      numbers[pos][0] = num + 1
     }
 
-    if useLegacyFormat {
-      progDescription = strings.ToLower(progDescription)
-      progDescription = strings.ReplaceAll(progDescription, "ё", "е")
-    }
-    _, ftsErr := ftsInsert.Exec(descrId, progDescription)
-    if (ftsErr != nil) {
-      return false, errors.New(s("FTS INSERT failed\n %s\n", ftsErr.Error()))
-    }
+    if len(numAndTotal) > 1 && numAndTotal[1] != "" {
+      total, totalErr := strconv.Atoi(numAndTotal[1])
+      if totalErr != nil || total < 0 {
+        return false
+      }
 
-    trimmedTotal += trimmed
+      numbers[pos][1] = total
+    }
   }
 
-  var imageDbId sql.NullInt64
-
-  if (len(programme.Images) != 0 && len(programme.Images[0].Uri) != 0) {
-    //fmt.Printf("image = %s", programme.Images[0].Uri)
-
-    firstUri := programme.Images[0].Uri
+  fields := [3][2]*int{
+    { &programme.Season, &programme.SeasonTotal },
+    { &programme.Episode, &programme.EpisodeTotal },
+    { &programme.Part, &programme.PartTotal },
+  }
 
-    if imageBaseUrl != nil {
-      parsedUrl, urlErr := url.Parse(firstUri)
+  for pos, numAndTotal := range numbers {
+    if numAndTotal[0] >= 0 {
+      *fields[pos][0] = numAndTotal[0]
+    }
 
-      if urlErr == nil && parsedUrl.IsAbs() {
-        parsedUrl.Host = imageBaseUrl.Host
+    if numAndTotal[1] > 0 {
+      *fields[pos][1] = numAndTotal[1]
+    }
+  }
 
-        if imageBaseUrl.Scheme != "" {
-          parsedUrl.Scheme = imageBaseUrl.Scheme
-        }
+  return true
+}
 
-        if imageBaseUrl.Path != "" && imageBaseUrl.Path != "/" {
-          parsedUrl.Path = imageBaseUrl.Path + parsedUrl.Path
-        }
+func parseOnscreen(programme *Programm, value string) bool {
+  // free-form, try common spellings: "S02E05", "2x05", "Сезон 2, серия 5", "5 серия"
 
-        firstUri = parsedUrl.String()
+  firstNum := func(match []string) int {
+    for _, group := range match[1:] {
+      if group != "" {
+        num, _ := strconv.Atoi(group)
+        return num
       }
     }
+    return 0
+  }
+
+  if match := onscreenRegexp1.FindStringSubmatch(value); match != nil {
+    programme.Season, _ = strconv.Atoi(match[1])
+    programme.Episode, _ = strconv.Atoi(match[2])
+    return true
+  }
 
-    uriId := ctx.uriMap[firstUri]
-    if uriId == 0 {
-      uriId = ctx.uriIdMax
-      ctx.uriIdMax += 1
+  if match := onscreenRegexp2.FindStringSubmatch(value); match != nil {
+    programme.Season, _ = strconv.Atoi(match[1])
+    programme.Episode, _ = strconv.Atoi(match[2])
+    return true
+  }
 
-      ctx.uriMap[firstUri] = uriId
+  seasonMatch := onscreenRegexp3.FindStringSubmatch(value)
+  episodeMatch := onscreenRegexp4.FindStringSubmatch(value)
 
-      _, uriErr := uriInsert.Exec(uriId, firstUri)
-      if (uriErr != nil) {
-        return false, errors.New(s("URI INSERT failed\n %s\n", uriErr.Error()))
-      }
+  if seasonMatch == nil && episodeMatch == nil {
+    if num, numErr := strconv.Atoi(value); numErr == nil && num > 0 {
+      programme.Episode = num
+      return true
     }
 
-    imageDbId = sql.NullInt64{
-      Int64: uriId,
-      Valid: true,
-    }
+    return false
+  }
+
+  if seasonMatch != nil {
+    programme.Season = firstNum(seasonMatch)
   }
 
-  progCategories := programme.Categories
+  if episodeMatch != nil {
+    programme.Episode = firstNum(episodeMatch)
+  }
 
-  for _, rawCategory := range progCategories {
-    nestedCats := strings.Split(rawCategory, ",")
+  return true
+}
 
-    for _, category := range nestedCats {
-      category = strings.TrimSpace(category)
+func addCredits(ctx *RequestContext, credits *Credits, programmeId int64, bulkTx *sql.Tx, existing map[string]struct{}) error {
+  textInsert := bulkTx.Stmt(ctx.sql4)
+  ftsInsert := bulkTx.Stmt(ctx.sql2)
+  creditInsert := bulkTx.Stmt(ctx.sql8)
 
-      tagInfo := ctx.tagMap[category]
+  addCredit := func(creditType string, name string, role string) error {
+    name = strings.TrimSpace(name)
+    if name == "" {
+      return nil
+    }
 
-      if tagInfo == nil {
-        newTagInfo := TagMeta{
-          NumberOfUses: 1,
-          IdVal: 0,
-        }
+    personId, textErr := addText(ctx, textInsert, ftsInsert, name)
+    if textErr != nil {
+      return textErr
+    }
 
-        ctx.tagMap[category] = &newTagInfo
+    var roleName sql.NullString
 
-        //fmt.Printf("Adding new tag %s for %s\n", category, progTitle)
-      } else {
-        tagInfo.NumberOfUses += 1
+    role = strings.TrimSpace(role)
+    if role != "" {
+      roleName = sql.NullString{
+        String: role,
+        Valid: true,
       }
     }
-  }
 
-  var caStr strings.Builder
+    // when merging, credits of the first programme are not added again
+    if existing != nil {
+      key := s("%d|%s|%s", personId, creditType, role)
 
-  for _, ca := range programme.Categories {
-    nestedCats := strings.Split(ca, ",")
+      if _, found := existing[key]; found {
+        return nil
+      }
 
-    for _, nca := range nestedCats {
-      caStr.WriteString(strings.TrimSpace(nca))
-      caStr.WriteString(",")
+      existing[key] = struct{}{}
     }
-  }
-
-  catsColumn := caStr.String()
 
-  var progYear sql.NullInt64
+    _, creditErr := creditInsert.Exec(programmeId, personId, creditType, roleName)
+    if creditErr != nil {
+      return errors.New(s("credits INSERT failed\n %s\n", creditErr.Error()))
+    }
 
-  if programme.Year != "" {
-    yearMatch := yearRegexp1.FindStringSubmatch(programme.Year)
-    if yearMatch != nil {
-      parsedYear, _ := strconv.Atoi(yearMatch[1])
+    return nil
+  }
 
-      progYear = sql.NullInt64{
-        Int64: int64(parsedYear),
-        Valid: true,
-      }
+  for _, director := range credits.Directors {
+    if err := addCredit("director", director, ""); err != nil {
+      return err
     }
   }
 
-  metaRes, metaErr := metaInsert.Exec(startTime.Unix(), chId, imageDbId, titleId, descrId, progYear, 0)
-  if (metaErr != nil) {
-    fmt.Printf("When parsing %s\n", programme.Title)
-
-    return false, errors.New(s("Meta INSERT failed\n %s\n", metaErr.Error()))
+  for _, actor := range credits.Actors {
+    if err := addCredit("actor", actor.Name, actor.Role); err != nil {
+      return err
+    }
   }
 
-  insertId, _ := metaRes.LastInsertId()
-
-  _, tagsErr := tagInsert.Exec(insertId, catsColumn)
-  if tagsErr != nil {
-    return false, errors.New(s("Tag INSERT failed\n %s\n", tagsErr.Error()))
+  otherCredits := []struct {
+    creditType string
+    names []string
+  }{
+    { "writer", credits.Writers },
+    { "adapter", credits.Adapters },
+    { "producer", credits.Producers },
+    { "composer", credits.Composers },
+    { "editor", credits.Editors },
+    { "presenter", credits.Presenters },
+    { "commentator", credits.Commentators },
+    { "guest", credits.Guests },
+  }
+
+  for _, other := range otherCredits {
+    for _, name := range other.names {
+      if err := addCredit(other.creditType, name, ""); err != nil {
+        return err
+      }
+    }
   }
 
-  return true, nil
+  return nil
 }
 
 func HomeRouterHandler(w http.ResponseWriter, r *http.Request) {
@@ -1687,10 +5291,9 @@ func HomeRouterHandler(w http.ResponseWriter, r *http.Request) {
 
   ctx.stringMap = make(map[string]int64)
   ctx.uriMap = make(map[string]int64)
+  ctx.aliasMap = make(map[string]struct{})
   ctx.tagMap = make(map[string]*TagMeta)
   ctx.endMap = make(map[string]*EndMeta)
-  ctx.bgnMap = make(map[string]*EndMeta)
-  ctx.limits = make(map[string][2]int64)
 
   ctx.textIdMax = 1
   ctx.uriIdMax = 1
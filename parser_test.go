@@ -0,0 +1,855 @@
+package main
+
+// run with: go test parser.go platform_default.go parser_test.go
+
+import (
+  "database/sql"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "path/filepath"
+  "strings"
+  "testing"
+  "text/template"
+  "time"
+)
+
+func FuzzParseXmltvDate(f *testing.F) {
+  compileRegexps()
+
+  localLocation = time.UTC
+
+  // zone with DST transitions exercises ambiguous and nonexistent times
+  berlin, zoneErr := time.LoadLocation("Europe/Berlin")
+  if zoneErr != nil {
+    f.Skipf("No time zone database: %s", zoneErr.Error())
+  }
+
+  for _, seed := range []string{
+    "200912291640",
+    "20091229",
+    "20091229164000+0300",
+    "20091229164000 Z",
+    "20091229164000 +03:00",
+    "20091229164000 +03",
+    "20201025023000",
+    "20200329023000",
+    "",
+    "2009",
+    "garbage",
+    "20091229164000 +99:99",
+    "99999999999999 -",
+  } {
+    f.Add(seed)
+  }
+
+  f.Fuzz(func(t *testing.T, source string) {
+    // nothing is checked but absence of panics: any input may be rejected
+    for _, zone := range []*time.Location{ nil, berlin } {
+      parsed, _, err := parseXmltvDate(source, zone, 0)
+      if err != nil {
+        continue
+      }
+
+      parseXmltvDate(source, zone, parsed.Unix())
+      parseXmltvDate(source, zone, parsed.Unix() - 3600)
+    }
+  })
+}
+
+func TestParseXmltvDate(t *testing.T) {
+  resetParserState()
+
+  // explicit offsets win over time zone of the process
+  localLocation = time.FixedZone("", 7 * 3600)
+
+  tests := []struct {
+    source string
+    expected int64
+  }{
+    { "200912291640", 1262079600 },
+    { "20091229", 1262019600 },
+    { "2009", 1230742800 },
+    { "20091229164000+0300", 1262094000 },
+    { "20091229164000 +0300", 1262094000 },
+    { "20091229164015 +0300", 1262094015 },
+    { "20091229164000 +03:00", 1262094000 },
+    { "20091229164000 +03", 1262094000 },
+    { "20091229164000 -0130", 1262110200 },
+    { "20091229164000Z", 1262104800 },
+    { "20091229164000 Z", 1262104800 },
+    { "20091229164000 utc", 1262104800 },
+    { " 20091229164000 +0300 ", 1262094000 },
+  }
+
+  for _, test := range tests {
+    parsed, dstKind, err := parseXmltvDate(test.source, nil, 0)
+    if err != nil {
+      t.Errorf("Failed to parse %q: %s", test.source, err.Error())
+      continue
+    }
+
+    if parsed.Unix() != test.expected || dstKind != 0 {
+      t.Errorf("%q was parsed as %d (DST %d), expected %d", test.source, parsed.Unix(), dstKind, test.expected)
+    }
+  }
+
+  for _, source := range []string{
+    "",
+    "200",
+    "20091",
+    "200912291",
+    "2009122916400",
+    "200912291640001",
+    "20091329",
+    "20091229164000 +0300 MSK",
+    "20091229164000 +0300x",
+    "20091229164000+03:0",
+    "20091229164000 +030",
+    "20091229164000 +9900",
+    "20091229164000 MSK",
+    "20091229164000 +",
+  } {
+    if parsed, _, err := parseXmltvDate(source, nil, 0); err == nil {
+      t.Errorf("%q was accepted as %s", source, parsed.Format(time.RFC3339))
+    }
+  }
+}
+
+func TestParseXmltvDateDst(t *testing.T) {
+  resetParserState()
+
+  berlin, zoneErr := time.LoadLocation("Europe/Berlin")
+  if zoneErr != nil {
+    t.Skipf("No time zone database: %s", zoneErr.Error())
+  }
+
+  tests := []struct {
+    source string
+    after int64
+    expected int64
+    dstKind int
+  }{
+    // 02:30 happens twice on 25.10.2020: at 00:30 UTC (CEST) and at 01:30 UTC (CET),
+    // without previous programme Go picks the latter
+    { "20201025023000", 0, 1603589400, DstAmbiguous },
+    { "20201025023000", 1603584000, 1603585800, DstAmbiguous },
+    { "20201025023000", 1603585800, 1603589400, DstAmbiguous },
+    // 02:30 doesn't happen on 29.03.2020, clock jumps from 02:00 CET to 03:00 CEST
+    { "20200329023000", 0, 1585445400, DstGap },
+    { "20200329023000", 1585440000, 1585441800, DstGap },
+    { "20200329023000", 1585442700, 1585445400, DstGap },
+    // times around transitions are not touched
+    { "20201025043000", 0, 1603596600, 0 },
+    { "20201025043000", 1603589400, 1603596600, 0 },
+    // zone replaces explicit offset
+    { "20201025023000 +0000", 1603584000, 1603585800, DstAmbiguous },
+  }
+
+  for _, test := range tests {
+    parsed, dstKind, err := parseXmltvDate(test.source, berlin, test.after)
+    if err != nil {
+      t.Errorf("Failed to parse %q: %s", test.source, err.Error())
+      continue
+    }
+
+    if parsed.Unix() != test.expected || dstKind != test.dstKind {
+      t.Errorf("%q after %d was parsed as %d (DST %d), expected %d (DST %d)", test.source, test.after, parsed.Unix(), dstKind, test.expected, test.dstKind)
+    }
+  }
+
+  // only zones from -tz and xmap are resolved, the process-local one is not
+  localLocation = berlin
+
+  if parsed, dstKind, _ := parseXmltvDate("20201025023000", nil, 1603584000); dstKind != 0 || parsed.Unix() != 1603589400 {
+    t.Errorf("Time in local zone was resolved as %d (DST %d)", parsed.Unix(), dstKind)
+  }
+
+  // first programme of channel has no previous one to be resolved by
+  xmltvTzOverride = berlin
+  startFrom = time.Date(2020, 10, 24, 0, 0, 0, 0, time.UTC)
+
+  slotTests := []struct {
+    lastStart int64
+    expected int64
+    flags int
+  }{
+    { 0, 1603589400, SlotDstAmbiguous | SlotDstUnresolved },
+    { 1603584000, 1603585800, SlotDstAmbiguous },
+  }
+
+  for _, test := range slotTests {
+    lastStarts := make(map[string]int64)
+    if test.lastStart != 0 {
+      lastStarts["ch1"] = test.lastStart
+    }
+
+    _, startTime, _, slotFlags := programmeSlot("ch1", "20201025023000", "", lastStarts)
+
+    if startTime.Unix() != test.expected || slotFlags != test.flags {
+      t.Errorf("Programme after %d starts at %d (flags %d), expected %d (flags %d)", test.lastStart, startTime.Unix(), slotFlags, test.expected, test.flags)
+    }
+  }
+}
+
+const testXmltv = `<?xml version="1.0" encoding="UTF-8"?><tv></tv>`
+
+func setupHttpTest(t *testing.T, cacheDir string, retries int) {
+  oldCacheDir, oldRetries, oldDelay := httpCacheDir, httpRetries, httpRetryDelay
+
+  httpCacheDir = cacheDir
+  httpRetries = retries
+  httpRetryDelay = time.Millisecond
+
+  t.Cleanup(func() {
+    httpCacheDir, httpRetries, httpRetryDelay = oldCacheDir, oldRetries, oldDelay
+  })
+}
+
+func readFile(t *testing.T, path string) string {
+  contents, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatalf("Failed to read %s: %s", path, err.Error())
+  }
+
+  return string(contents)
+}
+
+func TestFetchXmltvOk(t *testing.T) {
+  setupHttpTest(t, t.TempDir(), 0)
+
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("ETag", `"v1"`)
+    w.Write([]byte(testXmltv))
+  }))
+  defer server.Close()
+
+  path, err := fetchXmltv(server.URL + "/guide.xml")
+  if err != nil {
+    t.Fatalf("fetchXmltv failed: %s", err.Error())
+  }
+
+  if contents := readFile(t, path); contents != testXmltv {
+    t.Errorf("Unexpected file contents: %q", contents)
+  }
+
+  if etag, _ := readHttpCacheMeta(strings.TrimSuffix(path, ".xmltv") + ".meta"); etag != `"v1"` {
+    t.Errorf("ETag was not saved to cache metadata, got %q", etag)
+  }
+}
+
+func TestFetchXmltvNotModified(t *testing.T) {
+  setupHttpTest(t, t.TempDir(), 0)
+
+  requests, conditional := 0, 0
+
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    requests++
+
+    if r.Header.Get("If-None-Match") == `"v1"` {
+      conditional++
+      w.WriteHeader(http.StatusNotModified)
+      return
+    }
+
+    w.Header().Set("ETag", `"v1"`)
+    w.Write([]byte(testXmltv))
+  }))
+  defer server.Close()
+
+  firstPath, err := fetchXmltv(server.URL)
+  if err != nil {
+    t.Fatalf("First fetchXmltv failed: %s", err.Error())
+  }
+
+  secondPath, err := fetchXmltv(server.URL)
+  if err != nil {
+    t.Fatalf("Second fetchXmltv failed: %s", err.Error())
+  }
+
+  if requests != 2 || conditional != 1 {
+    t.Errorf("Expected 2 requests with 1 conditional, got %d and %d", requests, conditional)
+  }
+
+  if firstPath != secondPath {
+    t.Errorf("Cached copy was not reused: %s != %s", firstPath, secondPath)
+  }
+
+  if contents := readFile(t, secondPath); contents != testXmltv {
+    t.Errorf("Unexpected cached contents: %q", contents)
+  }
+}
+
+func TestFetchXmltvRetryFail(t *testing.T) {
+  setupHttpTest(t, t.TempDir(), 2)
+
+  requests := 0
+
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    requests++
+    w.WriteHeader(http.StatusServiceUnavailable)
+  }))
+  defer server.Close()
+
+  _, err := fetchXmltv(server.URL)
+  if err == nil {
+    t.Fatalf("fetchXmltv succeeded, while server always fails")
+  }
+
+  if requests != 3 {
+    t.Errorf("Expected 3 attempts, got %d", requests)
+  }
+
+  if !strings.Contains(err.Error(), "503") {
+    t.Errorf("Error does not mention server status: %s", err.Error())
+  }
+}
+
+// resetParserState restores defaults of command line options and clears statistics,
+// left by previous conversions
+func resetParserState() {
+  compileRegexps()
+
+  eltDateFormat = "02-01-2006 15:04"
+  localLocation = time.UTC
+  xmltvTzOverride = nil
+  startFrom = time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+  spanDuration = 48 * time.Hour
+  dbEarliestDate = nil
+  dbLastDate = nil
+  snippetLength = -1
+  imageBaseUrl = nil
+
+  lastEntry := "Конец передачи"
+  fakeEnd = &lastEntry
+
+  compiledTemplate = template.Must(template.New("title").Option("missingkey=error").Parse("{{.Title}}"))
+
+  idMap = nil
+  channelBlacklist, channelWhitelist = nil, nil
+  categoryMap = nil
+  excludeYear, excludeTags, allTags = false, false, false
+  langPrefs, storeTranslations = nil, false
+
+  sourceNames, sourcePriority, sourceAuto = nil, nil, false
+  sourceScores, channelOrders = nil, nil
+  acceptedSlots, sourceSpans = nil, nil
+  channelPriorities = make(map[string][]int)
+  enrichProgrammes, enrichWindow = false, 15 * time.Minute
+  enrichedSlots = make(map[string]int)
+
+  duplicatePolicy, overlapPolicy = "fail", "keep"
+  gapFillerLength, gapFillerText = 0, "Нет информации"
+  overlapSlots = make(map[string]int)
+  gapSlots = make(map[string]int)
+  duplicateSlots = make(map[string]int)
+
+  tagRegistryFile = ""
+  tagRegistry = make(map[string]int)
+  tagRegistryChanged = false
+  unmappedCategories = make(map[string]int)
+
+  mappedTotal, trimmedTotal, badEpisodeNums, badStopTimes, badStartTimes = 0, 0, 0, 0, 0
+  dstAdjustments = nil
+  unknownCountries = make(map[string]int)
+  unknownLanguages = make(map[string]int)
+  snippetLengthMax, dvrLength, archivedChannels = 0, 0, 0
+}
+
+// convertXmltv runs the same steps as main on XMLTV documents and returns resulting database;
+// options must be set after resetParserState and before the call
+func convertXmltv(t *testing.T, sources ...string) *sql.DB {
+  tempDir := t.TempDir()
+
+  sourcePaths := make([]string, len(sources))
+  sourceNames = make([]string, len(sources))
+
+  for pos, source := range sources {
+    sourcePaths[pos] = filepath.Join(tempDir, fmt.Sprintf("source%d.xml", pos + 1))
+    sourceNames[pos] = sourcePaths[pos]
+
+    if err := ioutil.WriteFile(sourcePaths[pos], []byte(source), 0644); err != nil {
+      t.Fatalf("Failed to write %s: %s", sourcePaths[pos], err.Error())
+    }
+  }
+
+  if len(sourcePaths) > 1 {
+    scanned := make(map[string][]ScannedSlot)
+
+    for pos, path := range sourcePaths {
+      if err := scanSource(path, pos, scanned); err != nil {
+        t.Fatalf("scanSource failed: %s", err.Error())
+      }
+    }
+
+    resolveSources(scanned)
+  }
+
+  db, err := sql.Open("sqlite3", "file:" + filepath.Join(tempDir, "epg.sqlite"))
+  if err != nil {
+    t.Fatalf("sqlite error: %s", err.Error())
+  }
+
+  t.Cleanup(func() {
+    db.Close()
+  })
+
+  ctx := RequestContext{}
+
+  ctx.db = db
+
+  ctx.stringMap = make(map[string]int64)
+  ctx.uriMap = make(map[string]int64)
+  ctx.aliasMap = make(map[string]struct{})
+  ctx.tagMap = make(map[string]*TagMeta)
+  ctx.endMap = make(map[string]*EndMeta)
+
+  ctx.textIdMax = 1
+  ctx.uriIdMax = 1
+
+  if err = initDb(&ctx, "main"); err != nil {
+    t.Fatalf("initDb failed: %s", err.Error())
+  }
+
+  for pos, source := range sources {
+    ctx.source = pos
+
+    if err = processXml(&ctx, "main", strings.NewReader(source)); err != nil {
+      t.Fatalf("processXml failed: %s", err.Error())
+    }
+  }
+
+  if err = finishDb(&ctx, "main"); err != nil {
+    t.Fatalf("finishDb failed: %s", err.Error())
+  }
+
+  return db
+}
+
+// queryRows returns rows of query result, with columns separated by '|'
+func queryRows(t *testing.T, db *sql.DB, query string, args ...interface{}) []string {
+  rows, err := db.Query(query, args...)
+  if err != nil {
+    t.Fatalf("Query failed: %s\n %s", query, err.Error())
+  }
+
+  defer rows.Close()
+
+  columns, _ := rows.Columns()
+
+  result := make([]string, 0)
+
+  for rows.Next() {
+    values := make([]sql.NullString, len(columns))
+    pointers := make([]interface{}, len(columns))
+
+    for pos := range values {
+      pointers[pos] = &values[pos]
+    }
+
+    if err = rows.Scan(pointers...); err != nil {
+      t.Fatalf("Scan failed: %s", err.Error())
+    }
+
+    fields := make([]string, len(columns))
+
+    for pos, value := range values {
+      if value.Valid {
+        fields[pos] = value.String
+      } else {
+        fields[pos] = "NULL"
+      }
+    }
+
+    result = append(result, strings.Join(fields, "|"))
+  }
+
+  return result
+}
+
+func expectRows(t *testing.T, db *sql.DB, expected []string, query string, args ...interface{}) {
+  t.Helper()
+
+  actual := queryRows(t, db, query, args...)
+
+  if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+    t.Errorf("Unexpected result of %s\n got:\n  %s\n expected:\n  %s", query, strings.Join(actual, "\n  "), strings.Join(expected, "\n  "))
+  }
+}
+
+const testCredits = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <programme start="20201201100000 +0000" stop="20201201110000 +0000" channel="ch1">
+    <title>Утренний эфир</title>
+    <credits>
+      <director>Иван Петров</director>
+      <actor role="Ведущий">Сергей Михалков</actor>
+    </credits>
+  </programme>
+  <programme start="20201201110000 +0000" stop="20201201120000 +0000" channel="ch1">
+    <title>Дневной эфир</title>
+    <credits>
+      <actor>Сергей Михалков</actor>
+    </credits>
+  </programme>
+</tv>`
+
+func TestCreditsSearchable(t *testing.T) {
+  resetParserState()
+
+  db := convertXmltv(t, testCredits)
+
+  // the same person is stored once, as a string of text table
+  expectRows(t, db, []string{ "Утренний эфир|director|Иван Петров|NULL", "Утренний эфир|actor|Сергей Михалков|Ведущий", "Дневной эфир|actor|Сергей Михалков|NULL" },
+    "SELECT title.text, credit_type, name.text, role FROM credits JOIN search_meta ON search_meta._id = programme_id JOIN text title ON title.docid = title_id JOIN text name ON name.docid = person_id ORDER BY start_time, credit_type DESC;")
+
+  expectRows(t, db, []string{ "Сергей Михалков" },
+    "SELECT text FROM text WHERE docid IN (SELECT docid FROM fts_search WHERE fts_search MATCH 'михалков');")
+}
+
+const testAgeRating = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <programme start="20201201100000 +0000" stop="20201201110000 +0000" channel="ch1">
+    <title lang="ru">Фильм (18+)</title>
+    <title lang="en">Film [16+]</title>
+    <rating system="MPAA"><value>PG</value></rating>
+  </programme>
+  <programme start="20201201110000 +0000" stop="20201201120000 +0000" channel="ch1">
+    <title lang="en">News (6+)</title>
+    <title lang="ru">Новости</title>
+  </programme>
+</tv>`
+
+func TestAgeRatingOfAllTitles(t *testing.T) {
+  resetParserState()
+
+  langPrefs = []string{ "en", "ru" }
+  storeTranslations = true
+
+  db := convertXmltv(t, testAgeRating)
+
+  // suffix of chosen title is stripped, suffixes of other titles aren't lost
+  expectRows(t, db, []string{ "Film|en|18|1", "News|en|6|0" },
+    "SELECT text, title_lang, age_rating, adult FROM search_meta JOIN text ON docid = title_id WHERE age_rating IS NOT NULL ORDER BY start_time;")
+
+  expectRows(t, db, []string{ "ru|Фильм", "ru|Новости" },
+    "SELECT lang, text FROM translations JOIN search_meta ON search_meta._id = programme_id JOIN text ON docid = translations.title_id ORDER BY start_time;")
+}
+
+const testCategories = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <programme start="20201201100000 +0000" stop="20201201110000 +0000" channel="ch1">
+    <title>Фильм</title>
+    <category>Х/ф, Боевик</category>
+    <category>Художественный фильм</category>
+  </programme>
+  <programme start="20201201110000 +0000" stop="20201201120000 +0000" channel="ch1">
+    <title>Новости</title>
+    <category>новости</category>
+  </programme>
+</tv>`
+
+func TestCategoryMap(t *testing.T) {
+  resetParserState()
+
+  mapPath := filepath.Join(t.TempDir(), "categories.map")
+
+  mapContents := "# category|genre|nibble\nХ/ф|Фильм|0x10\n Художественный фильм | Фильм | 10\nНовости|Новости|0x20\n"
+  if err := ioutil.WriteFile(mapPath, []byte(mapContents), 0644); err != nil {
+    t.Fatalf("Failed to write %s: %s", mapPath, err.Error())
+  }
+
+  loadCategoryMap(mapPath)
+
+  db := convertXmltv(t, testCategories)
+
+  // categories, mapped to the same genre, become a single tag; unknown ones are kept as is
+  expectRows(t, db, []string{ "Фильм|16|Боевик,Фильм", "Новости|32|Новости" },
+    "SELECT text, content_nibble, (SELECT group_concat(tag) FROM (SELECT tag FROM tags WHERE search_meta.tags & tags._id != 0 ORDER BY tag)) FROM search_meta JOIN text ON docid = title_id WHERE content_nibble IS NOT NULL ORDER BY start_time;")
+
+  if len(unmappedCategories) != 1 || unmappedCategories["Боевик"] != 1 {
+    t.Errorf("Unexpected unmapped categories: %v", unmappedCategories)
+  }
+}
+
+const testTags = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <programme start="20201201100000 +0000" stop="20201201110000 +0000" channel="ch1">
+    <title>Футбол</title>
+    <category>Спорт</category>
+  </programme>
+  <programme start="20201201110000 +0000" stop="20201201120000 +0000" channel="ch1">
+    <title>Кино</title>
+    <category>Фильм</category>
+    <category>Новинка</category>
+  </programme>
+</tv>`
+
+func TestTagRegistry(t *testing.T) {
+  resetParserState()
+
+  tagRegistryFile = filepath.Join(t.TempDir(), "tags.reg")
+
+  // spaces around tags are not a part of them, "Новости" keeps its bit, while it's not used
+  registryContents := "# bit|tag\n5| Спорт\r\n0|Новости \n"
+  if err := ioutil.WriteFile(tagRegistryFile, []byte(registryContents), 0644); err != nil {
+    t.Fatalf("Failed to write %s: %s", tagRegistryFile, err.Error())
+  }
+
+  loadTagRegistry(tagRegistryFile)
+
+  db := convertXmltv(t, testTags)
+
+  expectRows(t, db, []string{ "2|Новинка", "4|Фильм", "32|Спорт" }, "SELECT _id, tag FROM tags ORDER BY _id;")
+
+  expectRows(t, db, []string{ "Футбол|32", "Кино|6" },
+    "SELECT text, tags FROM search_meta JOIN text ON docid = title_id WHERE end_time IS NOT NULL ORDER BY start_time;")
+
+  if !tagRegistryChanged {
+    t.Fatalf("New tags were not added to registry")
+  }
+
+  if err := saveTagRegistry(tagRegistryFile); err != nil {
+    t.Fatalf("saveTagRegistry failed: %s", err.Error())
+  }
+
+  expected := "# bit|tag, generated by parser, bits of existing tags must not be changed\n0|Новости\n1|Новинка\n2|Фильм\n5|Спорт\n"
+  if contents := readFile(t, tagRegistryFile); contents != expected {
+    t.Errorf("Unexpected registry contents:\n%s", contents)
+  }
+}
+
+const testDuplicates = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <programme start="20201201100000 +0000" stop="20201201110000 +0000" channel="ch1">
+    <title>First</title>
+    <credits><actor>Иван Петров</actor></credits>
+    <icon src="http://img/a.jpg"/>
+  </programme>
+  <programme start="20201201100000 +0000" stop="20201201120000 +0000" channel="ch1">
+    <title>Later dup</title>
+    <desc>Later description</desc>
+    <credits><director>Пётр Иванов</director><actor>Иван Петров</actor></credits>
+    <icon src="http://img/a.jpg"/>
+    <icon src="http://img/b.jpg"/>
+  </programme>
+  <programme start="20201201120000 +0000" stop="20201201130000 +0000" channel="ch1">
+    <title>Next</title>
+  </programme>
+</tv>`
+
+func TestDuplicatePolicies(t *testing.T) {
+  tests := []struct {
+    policy string
+    programme string
+    credits string
+    images string
+  }{
+    { "first", "First||10:00-11:00", "actor:Иван Петров", "http://img/a.jpg" },
+    { "last", "Later dup|Later description|10:00-12:00", "actor:Иван Петров,director:Пётр Иванов", "http://img/a.jpg,http://img/b.jpg" },
+    { "longest", "Later dup|Later description|10:00-12:00", "actor:Иван Петров,director:Пётр Иванов", "http://img/a.jpg,http://img/b.jpg" },
+    { "merge", "First|Later description|10:00-11:00", "actor:Иван Петров,director:Пётр Иванов", "http://img/a.jpg,http://img/b.jpg" },
+  }
+
+  for _, test := range tests {
+    t.Run(test.policy, func(t *testing.T) {
+      resetParserState()
+
+      duplicatePolicy = test.policy
+
+      db := convertXmltv(t, testDuplicates)
+
+      expectRows(t, db, []string{ test.programme },
+        "SELECT title.text, descr.text, strftime('%H:%M', start_time, 'unixepoch') || '-' || strftime('%H:%M', end_time, 'unixepoch') FROM search_meta JOIN text title ON title.docid = title_id JOIN text descr ON descr.docid = description_id WHERE start_time = 1606816800;")
+
+      expectRows(t, db, []string{ test.credits },
+        "SELECT group_concat(credit, ',') FROM (SELECT credit_type || ':' || text AS credit FROM credits JOIN text ON docid = person_id ORDER BY credit);")
+
+      expectRows(t, db, []string{ test.images },
+        "SELECT group_concat(uri, ',') FROM (SELECT uri FROM programme_images JOIN uri ON uri._id = uri_id ORDER BY uri);")
+
+      // texts of dropped programmes must not be stored
+      if test.policy == "first" || test.policy == "merge" {
+        expectRows(t, db, []string{}, "SELECT text FROM text WHERE text = 'Later dup';")
+      }
+
+      if duplicateSlots["ch1"] != 1 {
+        t.Errorf("Expected 1 duplicate, got %d", duplicateSlots["ch1"])
+      }
+    })
+  }
+}
+
+const testOverlaps = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <programme start="20201201200000 +0000" stop="20201201213000 +0000" channel="ch1"><title>Фильм</title></programme>
+  <programme start="20201201210000 +0000" stop="20201201211500 +0000" channel="ch1"><title>Новости</title></programme>
+  <programme start="20201201211500 +0000" stop="20201201220000 +0000" channel="ch1"><title>Шоу</title></programme>
+  <programme start="20201201230000 +0000" stop="20201201233000 +0000" channel="ch1"><title>Поздно</title></programme>
+  <programme start="20201201233500 +0000" stop="20201201234000 +0000" channel="ch1"><title>Ночь</title></programme>
+</tv>`
+
+func TestOverlapsAndGaps(t *testing.T) {
+  tests := []struct {
+    policy string
+    fillGaps time.Duration
+    overlaps int
+    gaps int
+    schedule []string
+  }{
+    { "keep", 30 * time.Minute, 1, 1, []string{ "20:00-21:30 Фильм", "21:00-21:15 Новости", "21:15-22:00 Шоу", "22:00-23:00 Нет информации", "23:00-23:30 Поздно", "23:35-23:40 Ночь" } },
+    { "trim", 30 * time.Minute, 1, 1, []string{ "20:00-21:00 Фильм", "21:00-21:15 Новости", "21:15-22:00 Шоу", "22:00-23:00 Нет информации", "23:00-23:30 Поздно", "23:35-23:40 Ночь" } },
+    { "drop-shorter", 30 * time.Minute, 2, 1, []string{ "20:00-21:30 Фильм", "21:30-23:00 Нет информации", "23:00-23:30 Поздно", "23:35-23:40 Ночь" } },
+    { "keep", 2 * time.Hour, 1, 0, []string{ "20:00-21:30 Фильм", "21:00-21:15 Новости", "21:15-22:00 Шоу", "23:00-23:30 Поздно", "23:35-23:40 Ночь" } },
+  }
+
+  for _, test := range tests {
+    t.Run(s("%s,%s", test.policy, test.fillGaps), func(t *testing.T) {
+      resetParserState()
+
+      overlapPolicy = test.policy
+      gapFillerLength = test.fillGaps
+
+      db := convertXmltv(t, testOverlaps)
+
+      // fake entry at the end of schedule has no end_time
+      expectRows(t, db, test.schedule,
+        "SELECT strftime('%H:%M', start_time, 'unixepoch') || '-' || strftime('%H:%M', end_time, 'unixepoch') || ' ' || text FROM search_meta JOIN text ON docid = title_id WHERE end_time IS NOT NULL ORDER BY start_time, end_time;")
+
+      if overlapSlots["ch1"] != test.overlaps || gapSlots["ch1"] != test.gaps {
+        t.Errorf("Expected %d overlaps and %d gaps, got %d and %d", test.overlaps, test.gaps, overlapSlots["ch1"], gapSlots["ch1"])
+      }
+
+      // text of placeholders is stored only if it's used
+      expectRows(t, db, []string{ s("%d", test.gaps) }, "SELECT COUNT(*) FROM text WHERE text = 'Нет информации';")
+    })
+  }
+}
+
+const testSource1 = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <programme start="20201201100000 +0000" stop="20201201110000 +0000" channel="ch1"><title>A1</title></programme>
+  <programme start="20201201110000 +0000" stop="20201201120000 +0000" channel="ch1"><title>A2</title></programme>
+  <programme start="20201201130000 +0000" stop="20201201140000 +0000" channel="ch1"><title>A4</title></programme>
+  <programme start="20201201100000 +0000" stop="20201201110000 +0000" channel="ch2"><title>X1</title></programme>
+</tv>`
+
+const testSource2 = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <programme start="20201201100000 +0000" stop="20201201120000 +0000" channel="ch1"><title>B1</title><desc>B1 description</desc><icon src="http://img/b1.jpg"/></programme>
+  <programme start="20201201120000 +0000" stop="20201201130000 +0000" channel="ch1"><title>B2</title><desc>B2 description</desc><icon src="http://img/b2.jpg"/></programme>
+  <programme start="20201201133000 +0000" stop="20201201143000 +0000" channel="ch1"><title>B3</title><desc>B3 description</desc><icon src="http://img/b3.jpg"/></programme>
+  <programme start="20201201100000 +0000" stop="20201201110000 +0000" channel="ch2"><title>Y1</title></programme>
+</tv>`
+
+const sourceSchedule = "SELECT ch_id || ' ' || strftime('%H:%M', start_time, 'unixepoch') || '-' || strftime('%H:%M', end_time, 'unixepoch') || ' ' || text FROM search_meta JOIN text ON docid = title_id WHERE end_time IS NOT NULL ORDER BY ch_id, start_time;"
+
+func TestSourcePriority(t *testing.T) {
+  tests := []struct {
+    name string
+    priority []int
+    channelPriority []int
+    schedule []string
+  }{
+    // less trusted file only fills the gap at 12:00, B3 overlaps A4 and is dropped
+    { "default", nil, nil, []string{ "ch1 10:00-11:00 A1", "ch1 11:00-12:00 A2", "ch1 12:00-13:00 B2", "ch1 13:00-14:00 A4", "ch2 10:00-11:00 X1" } },
+    { "reversed", []int{ 2, 1 }, nil, []string{ "ch1 10:00-12:00 B1", "ch1 12:00-13:00 B2", "ch1 13:30-14:30 B3", "ch2 10:00-11:00 Y1" } },
+    // channel priority from xmap wins over -source-priority, missing files are trusted less
+    { "channel", []int{ 2 }, []int{ 1 }, []string{ "ch1 10:00-11:00 A1", "ch1 11:00-12:00 A2", "ch1 12:00-13:00 B2", "ch1 13:00-14:00 A4", "ch2 10:00-11:00 Y1" } },
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      resetParserState()
+
+      sourcePriority = test.priority
+      if test.channelPriority != nil {
+        channelPriorities["ch1"] = test.channelPriority
+      }
+
+      db := convertXmltv(t, testSource1, testSource2)
+
+      expectRows(t, db, test.schedule, sourceSchedule)
+    })
+  }
+
+  // report lists adjacent programmes of one file as a single span
+  expected := []SourceSpan{ { 0, 1606816800, 1606824000 }, { 1, 1606824000, 1606827600 }, { 0, 1606827600, 1606831200 } }
+
+  resetParserState()
+  convertXmltv(t, testSource1, testSource2)
+
+  if spans := sourceSpans["ch1"]; s("%v", spans) != s("%v", expected) {
+    t.Errorf("Unexpected spans of ch1: %v", spans)
+  }
+}
+
+func TestSourceAuto(t *testing.T) {
+  resetParserState()
+
+  // the second file has descriptions and images and no gaps, so it's better for ch1;
+  // files are equal for ch2, so order of -input is kept there
+  sourceAuto = true
+
+  db := convertXmltv(t, testSource1, testSource2)
+
+  expectRows(t, db, []string{ "ch1 10:00-12:00 B1", "ch1 12:00-13:00 B2", "ch1 13:30-14:30 B3", "ch2 10:00-11:00 X1" }, sourceSchedule)
+
+  if order := channelOrders["ch1"]; len(order) != 2 || order[0] != 1 {
+    t.Errorf("Unexpected order of sources for ch1: %v", order)
+  }
+
+  if scores := sourceScores["ch1"]; len(scores) != 2 || scores[0].DescriptionShare != 1 || scores[1].Problems != 1 {
+    t.Errorf("Unexpected scores of ch1: %+v", scores)
+  }
+
+  // fixed priority of channel is not overriden by scores
+  resetParserState()
+
+  sourceAuto = true
+  channelPriorities["ch1"] = []int{ 1, 2 }
+
+  db = convertXmltv(t, testSource1, testSource2)
+
+  expectRows(t, db, []string{ "ch1 10:00-11:00 A1", "ch1 11:00-12:00 A2", "ch1 12:00-13:00 B2", "ch1 13:00-14:00 A4", "ch2 10:00-11:00 X1" }, sourceSchedule)
+}
+
+const testEnrichPrimary = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <programme start="20201201100000 +0000" stop="20201201110000 +0000" channel="ch1"><title>Фильм «Брат»</title></programme>
+  <programme start="20201201110000 +0000" stop="20201201120000 +0000" channel="ch1"><title>Новости</title><desc>Главное</desc></programme>
+</tv>`
+
+const testEnrichSecondary = `<?xml version="1.0" encoding="UTF-8"?>
+<tv>
+  <programme start="20201201100500 +0000" stop="20201201110500 +0000" channel="ch1">
+    <title>Брат</title><desc>Криминальная драма</desc><year>1997</year><icon src="http://img/brat.jpg"/>
+  </programme>
+  <programme start="20201201110500 +0000" stop="20201201120000 +0000" channel="ch1">
+    <title>Погода</title><desc>Прогноз</desc>
+  </programme>
+</tv>`
+
+func TestEnrichment(t *testing.T) {
+  for _, enrich := range []bool{ false, true } {
+    resetParserState()
+
+    enrichProgrammes = enrich
+
+    db := convertXmltv(t, testEnrichPrimary, testEnrichSecondary)
+
+    // timing and title of the primary programme are kept, not similar titles are ignored
+    expected := []string{ "10:00-11:00|Фильм «Брат»||NULL|NULL", "11:00-12:00|Новости|Главное|NULL|NULL" }
+    if enrich {
+      expected[0] = "10:00-11:00|Фильм «Брат»|Криминальная драма|1997|http://img/brat.jpg"
+    }
+
+    expectRows(t, db, expected,
+      "SELECT strftime('%H:%M', start_time, 'unixepoch') || '-' || strftime('%H:%M', end_time, 'unixepoch'), title.text, descr.text, year, uri FROM search_meta JOIN text title ON title.docid = title_id JOIN text descr ON descr.docid = description_id LEFT JOIN uri ON uri._id = image_uri WHERE end_time IS NOT NULL ORDER BY start_time;")
+
+    if enrich && enrichedSlots["ch1"] != 1 {
+      t.Errorf("Expected 1 enriched programme, got %d", enrichedSlots["ch1"])
+    }
+  }
+}